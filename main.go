@@ -1,25 +1,80 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jsiebens/cloud-tunnel/internal/version"
+	"github.com/jsiebens/cloud-tunnel/pkg/logging"
+	"github.com/jsiebens/cloud-tunnel/pkg/metrics"
 	"github.com/jsiebens/cloud-tunnel/pkg/proxy"
 	"github.com/jsiebens/cloud-tunnel/pkg/remotedialer"
+	"github.com/jsiebens/cloud-tunnel/pkg/tracing"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
+// adminTokenEnv holds the default admin api token, keeping it out of the process list.
+const adminTokenEnv = "CLOUD_TUNNEL_ADMIN_TOKEN"
+
 func main() {
 	cmd := &cobra.Command{}
 
+	var logLevel string
+	var logFormat string
+	var metricsAddr string
+	var otlpEndpoint string
+	var shutdownTracing func(context.Context) error
+
+	cmd.PersistentFlags().StringVarP(&logLevel, "log-level", "", "info", "")
+	cmd.PersistentFlags().StringVarP(&logFormat, "log-format", "", logging.FormatText, "")
+	cmd.PersistentFlags().StringVarP(&metricsAddr, "metrics-addr", "", "", "")
+	cmd.PersistentFlags().StringVarP(&otlpEndpoint, "otlp-endpoint", "", "", "")
+
+	cmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		// the logs of exec are mixed with the output of the command it runs
+		if cmd.Name() == "exec" && !cmd.Flags().Changed("log-level") {
+			logLevel = "warn"
+		}
+
+		if err := logging.Setup(logLevel, logFormat); err != nil {
+			return err
+		}
+
+		if metricsAddr != "" {
+			if err := metrics.Start(metricsAddr); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		shutdownTracing, err = tracing.Start(cmd.Context(), otlpEndpoint)
+		return err
+	}
+
+	cmd.PersistentPostRunE = func(cmd *cobra.Command, args []string) error {
+		return shutdownTracing(context.Background())
+	}
+
 	cmd.AddCommand(versionCommand())
 	cmd.AddCommand(serverCommand())
 	cmd.AddCommand(tcpForwardCommand())
 	cmd.AddCommand(proxyCommand())
+	cmd.AddCommand(statusCommand())
+	cmd.AddCommand(doctorCommand())
+	cmd.AddCommand(execCommand())
+	cmd.AddCommand(pacCommand())
 
 	if err := cmd.Execute(); err != nil {
+		var exitErr *proxy.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		os.Exit(1)
 	}
 }
@@ -31,15 +86,50 @@ func serverCommand() *cobra.Command {
 	}
 
 	var addr string
-	var timeout time.Duration
-	var allowedUpstreams []string
+	var configFile string
+	var c = proxy.ServerConfig{}
 
 	cmd.Flags().StringVarP(&addr, "listen-addr", "", ":7654", "")
-	cmd.Flags().DurationVarP(&timeout, "dial-timeout", "", proxy.DefaultTimeout, "")
-	cmd.Flags().StringSliceVarP(&allowedUpstreams, "allowed-upstream", "", []string{}, "")
+	cmd.Flags().DurationVarP(&c.Timeout, "dial-timeout", "", proxy.DefaultTimeout, "")
+	cmd.Flags().StringSliceVarP(&c.AllowedUpstreams, "allowed-upstream", "", []string{}, "")
+	cmd.Flags().Uint32VarP(&c.Mux.WindowSize, "mux-window-size", "", 0, "")
+	cmd.Flags().DurationVarP(&c.Mux.KeepAliveInterval, "mux-keepalive-interval", "", 0, "")
+	cmd.Flags().IntVarP(&c.Mux.AcceptBacklog, "mux-accept-backlog", "", 0, "")
+	cmd.Flags().DurationVarP(&c.Timeouts.IdleTimeout, "idle-timeout", "", 0, "")
+	cmd.Flags().DurationVarP(&c.Timeouts.MaxDuration, "max-duration", "", 0, "")
+	cmd.Flags().IntVarP(&c.Limits.MaxConnections, "max-connections", "", 0, "")
+	cmd.Flags().IntVarP(&c.Limits.MaxConnectionsPerPrincipal, "max-connections-per-principal", "", 0, "")
+	cmd.Flags().IntVarP(&c.Limits.MaxStreamsPerSession, "max-streams-per-session", "", 0, "")
+	cmd.Flags().Float64VarP(&c.Limits.DialRate, "dial-rate", "", 0, "")
+	cmd.Flags().Float64VarP(&c.Limits.DialRatePerPrincipal, "dial-rate-per-principal", "", 0, "")
+	cmd.Flags().IntVarP(&c.Limits.Bandwidth, "bandwidth", "", 0, "")
+	cmd.Flags().IntVarP(&c.Limits.BandwidthPerPrincipal, "bandwidth-per-principal", "", 0, "")
+	cmd.Flags().StringVarP(&c.AccessLog.Path, "access-log", "", "", "")
+	cmd.Flags().StringVarP(&c.AccessLog.Format, "access-log-format", "", "json", "")
+	cmd.Flags().StringVarP(&c.ReadinessProbe, "readiness-probe", "", "", "")
+	cmd.Flags().DurationVarP(&c.DrainTimeout, "drain-timeout", "", proxy.DefaultDrainTimeout, "")
+	cmd.Flags().DurationVarP(&c.DeferredTimeout, "deferred-timeout", "", remotedialer.DefaultDeferredTimeout, "")
+	cmd.Flags().StringVarP(&c.Admin.ListenAddr, "admin-addr", "", "", "")
+	cmd.Flags().StringVarP(&c.Admin.Token, "admin-token", "", "", "")
+	cmd.Flags().StringVarP(&configFile, "config", "", "", "")
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
-		return proxy.StartServer(addr, timeout, allowedUpstreams)
+		// settings in the config file take precedence over the flags
+		if configFile != "" {
+			content, err := os.ReadFile(configFile)
+			if err != nil {
+				return err
+			}
+			if err = yaml.Unmarshal(content, &c); err != nil {
+				return err
+			}
+		}
+		c.Admin.Token = adminToken(c.Admin.Token)
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		return proxy.StartServer(ctx, addr, c)
 	}
 
 	return cmd
@@ -56,13 +146,12 @@ func tcpForwardCommand() *cobra.Command {
 
 	cmd.Flags().StringVarP(&addr, "listen-addr", "", "127.0.0.1:8080", "")
 	cmd.Flags().StringVarP(&c.Upstream, "upstream", "", "", "")
-	cmd.Flags().StringVarP(&c.ServiceUrl, "service-url", "", "", "")
-	cmd.Flags().StringVarP(&c.ServiceAccount, "service-account", "", "", "")
-	cmd.Flags().StringVarP(&c.Instance, "instance", "", "", "")
-	cmd.Flags().IntVarP(&c.Port, "port", "", remotedialer.DefaultServerPort, "")
-	cmd.Flags().StringVarP(&c.Project, "project", "", "", "")
-	cmd.Flags().StringVarP(&c.Zone, "zone", "", "", "")
-	cmd.Flags().BoolVarP(&c.MuxEnabled, "mux", "", false, "")
+	tunnelFlags(cmd, &c.Tunnel)
+	cmd.Flags().DurationVarP(&c.Timeouts.IdleTimeout, "idle-timeout", "", 0, "")
+	cmd.Flags().DurationVarP(&c.Timeouts.MaxDuration, "max-duration", "", 0, "")
+	cmd.Flags().StringVarP(&c.AccessLog.Path, "access-log", "", "", "")
+	cmd.Flags().StringVarP(&c.AccessLog.Format, "access-log-format", "", "json", "")
+	cmd.Flags().StringVarP(&c.ControlSocket, "control-socket", "", proxy.DefaultControlSocket("tcp-forward"), "")
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
 		return proxy.StartTcpForward(cmd.Context(), addr, c)
@@ -80,41 +169,255 @@ func proxyCommand() *cobra.Command {
 	var (
 		addr       string
 		configFile string
+		config     = proxy.ProxyConfig{}
 		rule       = proxy.Rule{Tunnel: proxy.Tunnel{}}
 	)
 
 	cmd.Flags().StringVarP(&addr, "listen-addr", "", "127.0.0.1:8080", "")
-	cmd.Flags().StringVarP(&rule.Tunnel.ServiceUrl, "service-url", "", "", "")
-	cmd.Flags().StringVarP(&rule.Tunnel.ServiceAccount, "service-account", "", "", "")
-	cmd.Flags().StringVarP(&rule.Tunnel.Instance, "instance", "", "", "")
-	cmd.Flags().IntVarP(&rule.Tunnel.Port, "port", "", remotedialer.DefaultServerPort, "")
-	cmd.Flags().StringVarP(&rule.Tunnel.Project, "project", "", "", "")
-	cmd.Flags().StringVarP(&rule.Tunnel.Zone, "zone", "", "", "")
-	cmd.Flags().BoolVarP(&rule.Tunnel.MuxEnabled, "mux", "", false, "")
-	cmd.Flags().StringSliceVarP(&rule.Upstreams, "upstream", "", []string{}, "")
+	proxyFlags(cmd, &config, &rule)
 	cmd.Flags().StringVarP(&configFile, "config", "", "", "")
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
-		config := proxy.ProxyConfig{}
+		config, err := proxyConfig(configFile, config, rule)
+		if err != nil {
+			return err
+		}
 
-		if configFile == "" {
-			config.Rules = []proxy.Rule{rule}
-		} else {
-			content, err := os.ReadFile(configFile)
-			if err != nil {
+		return proxy.StartProxy(cmd.Context(), addr, config)
+	}
+
+	return cmd
+}
+
+func statusCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "status",
+		Short:        "Display the status of the running proxy and tcp-forward processes",
+		SilenceUsage: true,
+	}
+
+	var socket string
+	var asJSON bool
+
+	cmd.Flags().StringVarP(&socket, "control-socket", "", "", "")
+	cmd.Flags().BoolVarP(&asJSON, "json", "", false, "")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		sockets := []string{socket}
+		if socket == "" {
+			var err error
+			if sockets, err = proxy.ControlSockets(); err != nil {
 				return err
 			}
-			if err = yaml.Unmarshal(content, &config); err != nil {
+		}
+
+		if len(sockets) == 0 {
+			return fmt.Errorf("no running proxy or tcp-forward found in %s", proxy.ControlSocketDir())
+		}
+
+		var statuses []*proxy.Status
+		for _, s := range sockets {
+			status, err := proxy.ReadStatus(cmd.Context(), s)
+			if err != nil {
+				return fmt.Errorf("reading status from %s: %w", s, err)
+			}
+			statuses = append(statuses, status)
+		}
+
+		if asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(statuses)
+		}
+
+		for i, status := range statuses {
+			if i > 0 {
+				fmt.Println()
+			}
+			if err := status.WriteText(os.Stdout); err != nil {
 				return err
 			}
 		}
+		return nil
+	}
 
-		return proxy.StartProxy(cmd.Context(), addr, config)
+	return cmd
+}
+
+func doctorCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "doctor",
+		Short:        "Diagnose a tunnel, checking every layer it depends on",
+		SilenceUsage: true,
+	}
+
+	var c = proxy.DoctorConfig{}
+
+	cmd.Flags().StringVarP(&c.Upstream, "upstream", "", "", "")
+	tunnelFlags(cmd, &c.Tunnel)
+	cmd.Flags().DurationVarP(&c.Timeout, "timeout", "", 10*time.Second, "")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return proxy.Doctor(cmd.Context(), c, func(check proxy.Check) {
+			fmt.Printf("[%s] %s", check.Result, check.Name)
+			if check.Detail != "" {
+				fmt.Printf(": %s", check.Detail)
+			}
+			fmt.Println()
+			if check.Hint != "" {
+				fmt.Printf("    hint: %s\n", check.Hint)
+			}
+		})
+	}
+
+	return cmd
+}
+
+func execCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "exec [flags] -- command [args...]",
+		Short:        "Run a command with its traffic going through a proxy of its own",
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+	}
+
+	var (
+		configFile string
+		config     = proxy.ProxyConfig{}
+		rule       = proxy.Rule{Tunnel: proxy.Tunnel{}}
+		noProxy    []string
+	)
+
+	cmd.Flags().SetInterspersed(false)
+	proxyFlags(cmd, &config, &rule)
+	cmd.Flags().StringSliceVarP(&noProxy, "no-proxy", "", []string{}, "")
+	cmd.Flags().StringVarP(&configFile, "config", "", "", "")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		config, err := proxyConfig(configFile, config, rule)
+		if err != nil {
+			return err
+		}
+
+		err = proxy.Exec(cmd.Context(), config, noProxy, args[0], args[1:]...)
+
+		// the command already reported why it failed
+		var exitErr *proxy.ExitError
+		if errors.As(err, &exitErr) {
+			cmd.SilenceErrors = true
+		}
+		return err
 	}
 
 	return cmd
 }
 
+func pacCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "pac",
+		Short:        "Print the proxy auto-config file the proxy serves at " + proxy.PACPath,
+		SilenceUsage: true,
+	}
+
+	var (
+		addr       string
+		configFile string
+		rule       = proxy.Rule{Tunnel: proxy.Tunnel{}}
+	)
+
+	// the same flags as the proxy, only the upstreams end up in the file
+	cmd.Flags().StringVarP(&addr, "listen-addr", "", "127.0.0.1:8080", "")
+	ruleFlags(cmd, &rule)
+	cmd.Flags().StringVarP(&configFile, "config", "", "", "")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		config, err := proxyConfig(configFile, proxy.ProxyConfig{}, rule)
+		if err != nil {
+			return err
+		}
+		if !config.Tunnelled() {
+			return errors.New("either a service url, an instance or an instance selector is required")
+		}
+
+		fmt.Print(config.PAC(addr))
+		return nil
+	}
+
+	return cmd
+}
+
+// tunnelFlags registers the flags configuring a tunnel, the same for every command opening one.
+func tunnelFlags(cmd *cobra.Command, t *proxy.Tunnel) {
+	cmd.Flags().StringVarP(&t.ServiceUrl, "service-url", "", "", "")
+	cmd.Flags().StringVarP(&t.ServiceAccount, "service-account", "", "", "")
+	cmd.Flags().StringVarP(&t.Transport, "transport", "", string(remotedialer.UpgradeTransport), "")
+	cmd.Flags().StringVarP(&t.Instance, "instance", "", "", "")
+	cmd.Flags().StringToStringVarP(&t.InstanceSelector.Labels, "instance-label", "", map[string]string{}, "")
+	cmd.Flags().StringVarP(&t.InstanceSelector.NamePrefix, "instance-prefix", "", "", "")
+	cmd.Flags().StringVarP(&t.InstanceSelector.InstanceGroup, "instance-group", "", "", "")
+	cmd.Flags().StringVarP(&t.InstanceStrategy, "instance-strategy", "", string(remotedialer.Failover), "")
+	cmd.Flags().IntVarP(&t.Port, "port", "", remotedialer.DefaultServerPort, "")
+	cmd.Flags().StringVarP(&t.Project, "project", "", "", "")
+	cmd.Flags().StringVarP(&t.Zone, "zone", "", "", "")
+	cmd.Flags().BoolVarP(&t.MuxEnabled, "mux", "", false, "")
+	cmd.Flags().IntVarP(&t.MuxConfig.MaxSessions, "mux-sessions", "", 1, "")
+	cmd.Flags().IntVarP(&t.MuxConfig.MaxStreamsPerSession, "mux-max-streams", "", 0, "")
+	cmd.Flags().StringVarP(&t.MuxConfig.Placement, "mux-placement", "", string(remotedialer.LeastStreams), "")
+	cmd.Flags().Uint32VarP(&t.MuxConfig.WindowSize, "mux-window-size", "", 0, "")
+	cmd.Flags().DurationVarP(&t.MuxConfig.KeepAliveInterval, "mux-keepalive-interval", "", 0, "")
+	cmd.Flags().IntVarP(&t.MuxConfig.AcceptBacklog, "mux-accept-backlog", "", 0, "")
+	cmd.Flags().DurationVarP(&t.MuxConfig.HealthCheckInterval, "mux-health-check-interval", "", remotedialer.DefaultHealthCheckInterval, "")
+	cmd.Flags().DurationVarP(&t.MuxConfig.HealthCheckTimeout, "mux-health-check-timeout", "", remotedialer.DefaultHealthCheckTimeout, "")
+	cmd.Flags().DurationVarP(&t.MuxConfig.MaxSessionAge, "mux-max-session-age", "", 0, "")
+	cmd.Flags().IntVarP(&t.Retry.MaxAttempts, "max-dial-attempts", "", remotedialer.DefaultMaxAttempts, "")
+	cmd.Flags().IntVarP(&t.Pool.Size, "pool-size", "", 0, "")
+}
+
+// ruleFlags registers the flags configuring the rule used when no config file is given.
+func ruleFlags(cmd *cobra.Command, r *proxy.Rule) {
+	tunnelFlags(cmd, &r.Tunnel)
+	cmd.Flags().StringSliceVarP(&r.Upstreams, "upstream", "", []string{}, "")
+}
+
+// proxyFlags registers the flags of the commands running a proxy.
+func proxyFlags(cmd *cobra.Command, c *proxy.ProxyConfig, r *proxy.Rule) {
+	ruleFlags(cmd, r)
+	cmd.Flags().DurationVarP(&c.Timeout, "dial-timeout", "", 0, "")
+	cmd.Flags().StringVarP(&c.AccessLog.Path, "access-log", "", "", "")
+	cmd.Flags().StringVarP(&c.AccessLog.Format, "access-log-format", "", "json", "")
+	cmd.Flags().StringVarP(&c.Admin.ListenAddr, "admin-addr", "", "", "")
+	cmd.Flags().StringVarP(&c.Admin.Token, "admin-token", "", "", "")
+	cmd.Flags().StringVarP(&c.ControlSocket, "control-socket", "", proxy.DefaultControlSocket(cmd.Name()), "")
+}
+
+// proxyConfig returns the config of a proxy, with the rule of the flags unless a config file is given. Settings in
+// the config file take precedence over the flags.
+func proxyConfig(configFile string, c proxy.ProxyConfig, r proxy.Rule) (proxy.ProxyConfig, error) {
+	if configFile == "" {
+		c.Rules = []proxy.Rule{r}
+	} else {
+		content, err := os.ReadFile(configFile)
+		if err != nil {
+			return c, err
+		}
+		if err = yaml.Unmarshal(content, &c); err != nil {
+			return c, err
+		}
+	}
+
+	c.Admin.Token = adminToken(c.Admin.Token)
+	return c, nil
+}
+
+// adminToken returns the token, or the one in the environment when none is set. The environment is only read when
+// the command runs, as a flag default it would be printed by --help.
+func adminToken(token string) string {
+	if token == "" {
+		return os.Getenv(adminTokenEnv)
+	}
+	return token
+}
+
 func versionCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:          "version",
@@ -0,0 +1,157 @@
+package iap
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const instanceRunning = "RUNNING"
+
+// labelKey matches the keys Compute Engine allows for labels.
+var labelKey = regexp.MustCompile(`^[\p{Ll}\p{Lo}][\p{Ll}\p{Lo}\p{N}_-]{0,62}$`)
+
+// NewComputeLookup returns a Lookup backed by the Compute Engine API.
+func NewComputeLookup(ctx context.Context, ts oauth2.TokenSource) (Lookup, error) {
+	svc, err := compute.NewService(ctx, option.WithTokenSource(ts))
+	if err != nil {
+		return nil, err
+	}
+	return &computeLookup{svc: svc}, nil
+}
+
+type computeLookup struct {
+	svc *compute.Service
+}
+
+func (c *computeLookup) LookupInstances(ctx context.Context, project, zone string, selector Selector) ([]Instance, error) {
+	var members map[string]bool
+	if selector.InstanceGroup != "" {
+		if zone == "" {
+			return nil, fmt.Errorf("a zone is required when selecting instances by instance group")
+		}
+
+		var err error
+		if members, err = c.groupMembers(ctx, project, zone, selector.InstanceGroup); err != nil {
+			return nil, err
+		}
+	}
+
+	var instances []Instance
+	var stopped error
+	add := func(zone string, items []*compute.Instance) {
+		for _, i := range items {
+			if !strings.HasPrefix(i.Name, selector.NamePrefix) {
+				continue
+			}
+			if members != nil && !members[i.Name] {
+				continue
+			}
+			if i.Status != instanceRunning {
+				if stopped == nil {
+					stopped = fmt.Errorf("%w: '%s' in zone '%s' is %s", ErrInstanceNotRunning, i.Name, zone, i.Status)
+				}
+				continue
+			}
+			instances = append(instances, Instance{Project: project, Zone: zone, Name: i.Name})
+		}
+	}
+
+	filter, err := instanceFilter(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	if zone != "" {
+		err := c.svc.Instances.List(project, zone).Filter(filter).Pages(ctx, func(list *compute.InstanceList) error {
+			add(zone, list.Items)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := c.svc.Instances.AggregatedList(project).Filter(filter).Pages(ctx, func(list *compute.InstanceAggregatedList) error {
+			for scope, items := range list.Items {
+				add(path.Base(scope), items.Instances)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(instances) == 0 && stopped != nil {
+		return nil, stopped
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].Zone != instances[j].Zone {
+			return instances[i].Zone < instances[j].Zone
+		}
+		return instances[i].Name < instances[j].Name
+	})
+
+	return instances, nil
+}
+
+func (c *computeLookup) groupMembers(ctx context.Context, project, zone, group string) (map[string]bool, error) {
+	members := make(map[string]bool)
+
+	err := c.svc.InstanceGroupManagers.ListManagedInstances(project, zone, group).Pages(ctx, func(resp *compute.InstanceGroupManagersListManagedInstancesResponse) error {
+		for _, i := range resp.ManagedInstances {
+			members[path.Base(i.Instance)] = true
+		}
+		return nil
+	})
+
+	return members, err
+}
+
+// instanceFilter returns the filter for the instances of the selector. Only running instances are listed, except for
+// a named instance, so one that isn't running is reported as such rather than as missing.
+func instanceFilter(selector Selector) (string, error) {
+	var terms []string
+
+	if selector.Name == "" {
+		terms = append(terms, fmt.Sprintf(`(status = "%s")`, instanceRunning))
+	} else {
+		if err := filterValue("name", selector.Name); err != nil {
+			return "", err
+		}
+		terms = append(terms, fmt.Sprintf(`(name = "%s")`, selector.Name))
+	}
+
+	keys := make([]string, 0, len(selector.Labels))
+	for k := range selector.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !labelKey.MatchString(k) {
+			return "", fmt.Errorf("invalid label key '%s'", k)
+		}
+		if err := filterValue("label "+k, selector.Labels[k]); err != nil {
+			return "", err
+		}
+		terms = append(terms, fmt.Sprintf(`(labels.%s = "%s")`, k, selector.Labels[k]))
+	}
+
+	return strings.Join(terms, " AND "), nil
+}
+
+// filterValue rejects values that would end the quoted string they are put in, the filter syntax has no escaping.
+func filterValue(name, v string) error {
+	if strings.ContainsAny(v, `"\`) {
+		return fmt.Errorf("%s '%s' contains a quote or backslash", name, v)
+	}
+	return nil
+}
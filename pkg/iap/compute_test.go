@@ -0,0 +1,179 @@
+package iap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeCompute serves the instances of the given zones like the Compute Engine API, applying the status and name
+// terms of the filter, and returns a lookup using it with the number of requests it got.
+func fakeCompute(t *testing.T, zones map[string][]*compute.Instance) (Lookup, *atomic.Int32) {
+	var requests atomic.Int32
+
+	matches := func(filter string, i *compute.Instance) bool {
+		if strings.Contains(filter, `(status = "RUNNING")`) && i.Status != "RUNNING" {
+			return false
+		}
+		if _, name, ok := strings.Cut(filter, `(name = "`); ok {
+			name, _, _ = strings.Cut(name, `"`)
+			return i.Name == name
+		}
+		return true
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /compute/v1/projects/{project}/aggregated/instances", func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		list := &compute.InstanceAggregatedList{Items: make(map[string]compute.InstancesScopedList)}
+		for zone, instances := range zones {
+			var items []*compute.Instance
+			for _, i := range instances {
+				if matches(req.URL.Query().Get("filter"), i) {
+					items = append(items, i)
+				}
+			}
+			list.Items["zones/"+zone] = compute.InstancesScopedList{Instances: items}
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	})
+	mux.HandleFunc("GET /compute/v1/projects/{project}/zones/{zone}/instances", func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		list := &compute.InstanceList{}
+		for _, i := range zones[req.PathValue("zone")] {
+			if matches(req.URL.Query().Get("filter"), i) {
+				list.Items = append(list.Items, i)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	svc, err := compute.NewService(context.Background(), option.WithEndpoint(server.URL+"/compute/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &computeLookup{svc: svc}, &requests
+}
+
+func TestComputeLookup(t *testing.T) {
+	lookup, _ := fakeCompute(t, map[string][]*compute.Instance{
+		"europe-west1-b": {
+			{Name: "vm-2", Status: "RUNNING", Labels: map[string]string{"role": "tunnel"}},
+			{Name: "vm-3", Status: "TERMINATED"},
+		},
+		"europe-west1-c": {
+			{Name: "vm-1", Status: "RUNNING"},
+			{Name: "db-1", Status: "RUNNING"},
+		},
+	})
+
+	tests := []struct {
+		name     string
+		zone     string
+		selector Selector
+		want     []string
+		err      error
+	}{
+		{name: "all zones", selector: Selector{NamePrefix: "vm-"}, want: []string{"europe-west1-b/vm-2", "europe-west1-c/vm-1"}},
+		{name: "zone", zone: "europe-west1-c", want: []string{"europe-west1-c/db-1", "europe-west1-c/vm-1"}},
+		{name: "name", selector: Selector{Name: "vm-1"}, want: []string{"europe-west1-c/vm-1"}},
+		{name: "not running", selector: Selector{Name: "vm-3"}, err: ErrInstanceNotRunning},
+		{name: "no match", selector: Selector{Name: "vm-4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instances, err := lookup.LookupInstances(context.Background(), "p", tt.zone, tt.selector)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+
+			var got []string
+			for _, i := range instances {
+				got = append(got, i.Zone+"/"+i.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeLookupReportsStatus(t *testing.T) {
+	lookup, _ := fakeCompute(t, map[string][]*compute.Instance{"europe-west1-b": {{Name: "vm-1", Status: "TERMINATED"}}})
+
+	_, err := lookup.LookupInstances(context.Background(), "p", "", Selector{Name: "vm-1"})
+	if want := "instance not running: 'vm-1' in zone 'europe-west1-b' is TERMINATED"; err == nil || err.Error() != want {
+		t.Fatalf("got %v, want %s", err, want)
+	}
+}
+
+func TestInstanceFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector Selector
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "labels",
+			selector: Selector{Labels: map[string]string{"role": "tunnel", "env": "prod"}},
+			want:     `(status = "RUNNING") AND (labels.env = "prod") AND (labels.role = "tunnel")`,
+		},
+		{
+			name:     "name",
+			selector: Selector{Name: "vm-1"},
+			want:     `(name = "vm-1")`,
+		},
+		{
+			name:     "quote in label value",
+			selector: Selector{Labels: map[string]string{"role": `x") OR (name = "y`}},
+			wantErr:  true,
+		},
+		{
+			name:     "backslash in label value",
+			selector: Selector{Labels: map[string]string{"role": `x\`}},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid label key",
+			selector: Selector{Labels: map[string]string{"role = x OR labels.a": "b"}},
+			wantErr:  true,
+		},
+		{
+			name:     "quote in name",
+			selector: Selector{Name: `vm"`},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := instanceFilter(tt.selector)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got filter %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
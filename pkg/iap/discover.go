@@ -0,0 +1,134 @@
+package iap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Invalidator is implemented by Instances that cache a lookup and can drop it once it turns out to be stale.
+type Invalidator interface {
+	Invalidate()
+}
+
+// DiscoverInstance returns Instances for a single named instance, looking up its zone when none is given.
+// Discovered zones are cached on disk so the lookup only happens once per instance.
+func DiscoverInstance(lookup Lookup, project, zone, name string) Instances {
+	if zone != "" {
+		return StaticInstance(project, zone, name)
+	}
+
+	return &discoveredInstance{lookup: lookup, project: project, name: name}
+}
+
+type discoveredInstance struct {
+	sync.Mutex
+	lookup  Lookup
+	project string
+	name    string
+	zone    string
+}
+
+func (d *discoveredInstance) Instances(ctx context.Context) ([]Instance, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	key := d.project + "/" + d.name
+
+	if d.zone == "" {
+		d.zone = loadZoneCache()[key]
+	}
+
+	if d.zone == "" {
+		instances, err := d.lookup.LookupInstances(ctx, d.project, "", Selector{Name: d.name})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(instances) == 0 {
+			return nil, fmt.Errorf("instance '%s' not found in project '%s'", d.name, d.project)
+		}
+
+		d.zone = instances[0].Zone
+
+		updateZoneCache(func(cache map[string]string) { cache[key] = d.zone })
+	}
+
+	return []Instance{{Project: d.project, Zone: d.zone, Name: d.name}}, nil
+}
+
+func (d *discoveredInstance) Invalidate() {
+	d.Lock()
+	defer d.Unlock()
+
+	key := d.project + "/" + d.name
+	d.zone = ""
+
+	updateZoneCache(func(cache map[string]string) { delete(cache, key) })
+}
+
+var zoneCacheLock sync.Mutex
+
+func zoneCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "cloud-tunnel", "zones.json")
+}
+
+func loadZoneCache() map[string]string {
+	zoneCacheLock.Lock()
+	defer zoneCacheLock.Unlock()
+
+	return readZoneCache()
+}
+
+func readZoneCache() map[string]string {
+	cache := make(map[string]string)
+
+	file := zoneCacheFile()
+	if file == "" {
+		return cache
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return cache
+	}
+
+	_ = json.Unmarshal(content, &cache)
+	return cache
+}
+
+func updateZoneCache(update func(map[string]string)) {
+	zoneCacheLock.Lock()
+	defer zoneCacheLock.Unlock()
+
+	file := zoneCacheFile()
+	if file == "" {
+		return
+	}
+
+	cache := readZoneCache()
+	update(cache)
+
+	content, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+
+	// the cache is only an optimisation, failing to write it is not an error
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		return
+	}
+	_ = os.Rename(tmp, file)
+}
@@ -0,0 +1,132 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/api/compute/v1"
+	"os"
+	"slices"
+	"testing"
+)
+
+// testCacheDir keeps the zone cache of the test in a directory of its own.
+func testCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("LocalAppData", dir)
+}
+
+func TestZoneCache(t *testing.T) {
+	testCacheDir(t)
+
+	if cache := loadZoneCache(); len(cache) != 0 {
+		t.Fatalf("got %v, want an empty cache", cache)
+	}
+
+	updateZoneCache(func(cache map[string]string) { cache["p/vm-1"] = "europe-west1-b" })
+	updateZoneCache(func(cache map[string]string) { cache["p/vm-2"] = "europe-west1-c" })
+	updateZoneCache(func(cache map[string]string) { delete(cache, "p/vm-1") })
+
+	if cache := loadZoneCache(); len(cache) != 1 || cache["p/vm-2"] != "europe-west1-c" {
+		t.Fatalf("got %v, want only vm-2", cache)
+	}
+
+	info, err := os.Stat(zoneCacheFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("got mode %v, want %v", info.Mode().Perm(), os.FileMode(0o600))
+	}
+
+	// a corrupt cache is ignored, it's only an optimisation
+	if err := os.WriteFile(zoneCacheFile(), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cache := loadZoneCache(); len(cache) != 0 {
+		t.Fatalf("got %v, want an empty cache", cache)
+	}
+}
+
+func TestDiscoverInstanceWithZone(t *testing.T) {
+	testCacheDir(t)
+
+	lookup, requests := fakeCompute(t, nil)
+
+	instances, err := DiscoverInstance(lookup, "p", "europe-west1-b", "vm-1").Instances(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Instance{{Project: "p", Zone: "europe-west1-b", Name: "vm-1"}}; !slices.Equal(instances, want) {
+		t.Fatalf("got %v, want %v", instances, want)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("got %d lookups, want none", n)
+	}
+}
+
+func TestDiscoverInstance(t *testing.T) {
+	testCacheDir(t)
+
+	zones := map[string][]*compute.Instance{"europe-west1-b": {{Name: "vm-1", Status: "RUNNING"}}}
+	lookup, requests := fakeCompute(t, zones)
+	want := []Instance{{Project: "p", Zone: "europe-west1-b", Name: "vm-1"}}
+
+	discovered := DiscoverInstance(lookup, "p", "", "vm-1")
+	for range 2 {
+		instances, err := discovered.Instances(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(instances, want) {
+			t.Fatalf("got %v, want %v", instances, want)
+		}
+	}
+
+	// the zone is kept on disk for the next process
+	if _, err := DiscoverInstance(lookup, "p", "", "vm-1").Instances(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("got %d lookups, want 1", n)
+	}
+
+	// once invalidated, the zone is looked up again
+	zones["europe-west1-c"], zones["europe-west1-b"] = zones["europe-west1-b"], nil
+	discovered.(Invalidator).Invalidate()
+
+	if zone := loadZoneCache()["p/vm-1"]; zone != "" {
+		t.Fatalf("got cached zone %s, want it removed", zone)
+	}
+
+	instances, err := discovered.Instances(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instances[0].Zone != "europe-west1-c" {
+		t.Fatalf("got zone %s, want europe-west1-c", instances[0].Zone)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("got %d lookups, want 2", n)
+	}
+}
+
+func TestDiscoverInstanceNotFound(t *testing.T) {
+	testCacheDir(t)
+
+	lookup, _ := fakeCompute(t, map[string][]*compute.Instance{"europe-west1-b": {{Name: "vm-2", Status: "TERMINATED"}}})
+
+	if _, err := DiscoverInstance(lookup, "p", "", "vm-1").Instances(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	_, err := DiscoverInstance(lookup, "p", "", "vm-2").Instances(context.Background())
+	if !errors.Is(err, ErrInstanceNotRunning) {
+		t.Fatalf("got %v, want %v", err, ErrInstanceNotRunning)
+	}
+
+	if cache := loadZoneCache(); len(cache) != 0 {
+		t.Fatalf("got %v, want nothing cached", cache)
+	}
+}
@@ -0,0 +1,116 @@
+package iap
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"nhooyr.io/websocket"
+)
+
+// close codes used by the IAP relay to signal why a tunnel was refused or dropped
+const (
+	closeCodeErrorUnknown             websocket.StatusCode = 4000
+	closeCodeSidHeaderInvalid         websocket.StatusCode = 4001
+	closeCodeSidUnknown               websocket.StatusCode = 4002
+	closeCodeFailedToConnectToBackend websocket.StatusCode = 4003
+	closeCodeReauthenticationRequired websocket.StatusCode = 4004
+	closeCodeDestinationWriteFailed   websocket.StatusCode = 4009
+	closeCodeDestinationReadFailed    websocket.StatusCode = 4010
+	closeCodeNotAuthorized            websocket.StatusCode = 4033
+	closeCodeLookupFailed             websocket.StatusCode = 4047
+	closeCodeLookupFailedReconnect    websocket.StatusCode = 4051
+)
+
+var (
+	ErrBackendUnreachable       = errors.New("failed to connect to backend")
+	ErrReauthenticationRequired = errors.New("reauthentication required")
+	ErrNotAuthorized            = errors.New("not authorized")
+	ErrInstanceNotFound         = errors.New("instance not found")
+	ErrInstanceNotRunning       = errors.New("instance not running")
+)
+
+// Error is returned when the IAP relay closes the tunnel with one of its own close codes.
+type Error struct {
+	Code     websocket.StatusCode
+	Reason   string
+	Instance string
+	Port     int
+	err      error
+}
+
+func newError(closeError websocket.CloseError, opts DialOptions) *Error {
+	e := &Error{
+		Code:     closeError.Code,
+		Reason:   closeError.Reason,
+		Instance: opts.Instance,
+		Port:     opts.Port,
+	}
+
+	switch closeError.Code {
+	case closeCodeFailedToConnectToBackend:
+		e.err = ErrBackendUnreachable
+	case closeCodeReauthenticationRequired:
+		e.err = ErrReauthenticationRequired
+	case closeCodeNotAuthorized:
+		e.err = ErrNotAuthorized
+	case closeCodeLookupFailed, closeCodeLookupFailedReconnect:
+		e.err = ErrInstanceNotFound
+	}
+
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("iap: %v: code %d (%s)", e.err, int(e.Code), e.Reason)
+	}
+	return fmt.Sprintf("iap: connection closed: code %d (%s)", int(e.Code), e.Reason)
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Temporary reports whether dialing again may succeed without any change on the caller's side.
+func (e *Error) Temporary() bool {
+	switch e.Code {
+	case closeCodeErrorUnknown,
+		closeCodeSidHeaderInvalid,
+		closeCodeSidUnknown,
+		closeCodeDestinationWriteFailed,
+		closeCodeDestinationReadFailed,
+		closeCodeLookupFailedReconnect:
+		return true
+	}
+	return false
+}
+
+// Hint returns a remediation for the error, or an empty string when there is none.
+func (e *Error) Hint() string {
+	switch {
+	case errors.Is(e, ErrBackendUnreachable):
+		return fmt.Sprintf("make sure a firewall rule allows ingress from 35.235.240.0/20 on port %d and the server is listening on instance '%s'", e.Port, e.Instance)
+	case errors.Is(e, ErrReauthenticationRequired):
+		return "credentials have expired, run 'gcloud auth application-default login' or refresh the service account credentials"
+	case errors.Is(e, ErrNotAuthorized):
+		return fmt.Sprintf("grant the caller roles/iap.tunnelResourceAccessor on instance '%s' and check the firewall allows port %d", e.Instance, e.Port)
+	case errors.Is(e, ErrInstanceNotFound):
+		return fmt.Sprintf("instance '%s' was not found, check the instance name, project and zone", e.Instance)
+	}
+	return ""
+}
+
+// StatusError is returned when the IAP proxy refuses the WebSocket handshake with an HTTP status, before any relay is set up.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("iap: handshake refused: %s", e.Status)
+}
+
+// Temporary reports whether dialing again may succeed, when the proxy is rate limiting or failing itself.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
@@ -8,10 +8,13 @@ import (
 	"fmt"
 	"golang.org/x/oauth2"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"nhooyr.io/websocket"
+	"sync/atomic"
+	"time"
 )
 
 var _ net.Conn = (*Conn)(nil)
@@ -32,9 +35,16 @@ const (
 
 // Dial connects to the IAP proxy and returns a Conn or error if the connection fails.
 func Dial(ctx context.Context, ts oauth2.TokenSource, opts DialOptions) (*Conn, error) {
+	c, err := dial(ctx, ts, opts)
+	connects.WithLabelValues(connectResult(err)).Inc()
+	return c, err
+}
+
+func dial(ctx context.Context, ts oauth2.TokenSource, opts DialOptions) (*Conn, error) {
 	header := make(http.Header)
 	header.Set("Origin", proxyOrigin)
 
+	var expiry time.Time
 	if ts != nil {
 		token, err := ts.Token()
 		if err != nil {
@@ -42,16 +52,21 @@ func Dial(ctx context.Context, ts oauth2.TokenSource, opts DialOptions) (*Conn,
 		}
 
 		header.Set("Authorization", fmt.Sprintf("%v %v", token.Type(), token.AccessToken))
+		expiry = token.Expiry
 	}
 
 	wsOptions := websocket.DialOptions{
 		HTTPHeader:      header,
 		Subprotocols:    []string{proxySubproto},
 		CompressionMode: websocket.CompressionDisabled,
+		HTTPClient:      opts.HTTPClient,
 	}
 
-	conn, _, err := websocket.Dial(ctx, opts.connectURL().String(), &wsOptions)
+	conn, resp, err := websocket.Dial(ctx, opts.connectURL().String(), &wsOptions)
 	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
 		return nil, err
 	}
 
@@ -65,12 +80,14 @@ func Dial(ctx context.Context, ts oauth2.TokenSource, opts DialOptions) (*Conn,
 		recvReader: recvReader,
 		recvWriter: recvWriter,
 		sendBuf:    make([]byte, subprotoMaxFrameSize),
+		expiry:     expiry,
+		addr:       Addr{Project: opts.Project, Zone: opts.Zone, Instance: opts.Instance, Port: opts.Port},
 	}
 
 	if err := c.readFrame(); err != nil {
 		var closeError websocket.CloseError
 		if errors.As(err, &closeError) {
-			return nil, fmt.Errorf("connection closed: code %v (%v)", int(closeError.Code), closeError.Reason)
+			return nil, newError(closeError, opts)
 		}
 
 		return nil, err
@@ -86,6 +103,9 @@ type DialOptions struct {
 	Zone     string
 	Instance string
 	Port     int
+
+	// HTTPClient performs the WebSocket handshake with the IAP proxy, http.DefaultClient when nil.
+	HTTPClient *http.Client
 }
 
 func (d DialOptions) connectURL() *url.URL {
@@ -124,12 +144,50 @@ type Conn struct {
 	sendNbAcked   uint64
 	sendNbUnacked uint64
 	sendBuf       []byte
+
+	expiry time.Time
+	addr   Addr
+
+	// ended is set once the relay closed the connection
+	ended atomic.Bool
+}
+
+// Addr is the address of an instance port reached through IAP.
+type Addr struct {
+	Project  string
+	Zone     string
+	Instance string
+	Port     int
+}
+
+func (a Addr) Network() string { return "iap" }
+
+func (a Addr) String() string {
+	return fmt.Sprintf("%s/%s/%s:%d", a.Project, a.Zone, a.Instance, a.Port)
+}
+
+// LogValue logs the address as a string, only formatting it when the log is written.
+func (a Addr) LogValue() slog.Value {
+	return slog.StringValue(a.String())
+}
+
+// RemoteAddr returns the instance and port the connection is tunnelled to.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// Expiry returns when the credentials the connection was opened with expire, after which IAP drops the connection.
+func (c *Conn) Expiry() time.Time {
+	return c.expiry
 }
 
 func (c *Conn) Close() error {
 	_ = c.recvReader.Close()
 	_ = c.recvWriter.Close()
-	return c.Conn.Close()
+	if err := c.Conn.Close(); err != nil && !c.ended.Load() {
+		return err
+	}
+	return nil
 }
 
 func (c *Conn) Read(buf []byte) (n int, err error) {
@@ -160,6 +218,8 @@ func (c *Conn) Write(data []byte) (n int, err error) {
 			return 0, err
 		}
 
+		slog.Debug("Sent IAP data frame", "addr", c.addr, "len", writeNb)
+
 		c.sendNbUnacked += uint64(writtenNb)
 	}
 
@@ -172,6 +232,8 @@ func (c *Conn) writeAck(nb uint64) error {
 	binary.BigEndian.PutUint16(buf[0:2], subprotoTagAck)
 	binary.BigEndian.PutUint64(buf[2:10], nb)
 
+	slog.Debug("Sent IAP ack frame", "addr", c.addr, "acked", nb)
+
 	_, err := c.Conn.Write(buf)
 	return err
 }
@@ -192,6 +254,8 @@ func (c *Conn) readSuccessFrame(r io.Reader) error {
 		return err
 	}
 
+	slog.Debug("Received IAP success frame", "addr", c.addr)
+
 	c.connected = true
 	return nil
 }
@@ -203,6 +267,7 @@ func (c *Conn) readAckFrame(r io.Reader) error {
 	}
 
 	c.sendNbAcked = binary.BigEndian.Uint64(buf[:])
+	slog.Debug("Received IAP ack frame", "addr", c.addr, "acked", c.sendNbAcked, "unacked", c.sendNbUnacked-c.sendNbAcked)
 	return nil
 }
 
@@ -222,6 +287,7 @@ func (c *Conn) readDataFrame(r io.Reader) error {
 	}
 
 	c.recvNbUnacked += uint64(frameLen)
+	slog.Debug("Received IAP data frame", "addr", c.addr, "len", frameLen)
 	return nil
 }
 
@@ -256,6 +322,7 @@ func (c *Conn) readFrame() error {
 			}
 		default:
 			// unknown tags should be ignored
+			slog.Debug("Ignoring IAP frame", "addr", c.addr, "tag", tag)
 			return nil
 		}
 
@@ -267,7 +334,11 @@ func (c *Conn) readFrame() error {
 func (c *Conn) read() {
 	for {
 		if err := c.readFrame(); err != nil {
-			_ = c.Close()
+			slog.Debug("IAP connection closed", "addr", c.addr, "err", err)
+			// what was received is still read before the error, io.EOF when the relay closed the connection normally
+			c.ended.Store(true)
+			_ = c.recvWriter.CloseWithError(err)
+			_ = c.Conn.Close()
 			return
 		}
 	}
@@ -0,0 +1,135 @@
+package iap
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const DefaultRefreshInterval = 5 * time.Minute
+
+type Instance struct {
+	Project string
+	Zone    string
+	Name    string
+}
+
+// Instances provides the instances a tunnel can be opened to.
+type Instances interface {
+	Instances(ctx context.Context) ([]Instance, error)
+}
+
+func StaticInstance(project, zone, name string) Instances {
+	return staticInstances{{Project: project, Zone: zone, Name: name}}
+}
+
+type staticInstances []Instance
+
+func (s staticInstances) Instances(context.Context) ([]Instance, error) {
+	return s, nil
+}
+
+type Selector struct {
+	Name          string
+	Labels        map[string]string
+	NamePrefix    string
+	InstanceGroup string
+}
+
+// Lookup finds the running instances matching a selector. An empty zone means all zones of the project.
+type Lookup interface {
+	LookupInstances(ctx context.Context, project, zone string, selector Selector) ([]Instance, error)
+}
+
+// NewResolver returns Instances matching the selector, looked up again every refresh interval until the context is done.
+func NewResolver(ctx context.Context, lookup Lookup, project, zone string, selector Selector, refresh time.Duration) *Resolver {
+	if refresh == 0 {
+		refresh = DefaultRefreshInterval
+	}
+
+	r := &Resolver{
+		lookup:   lookup,
+		project:  project,
+		zone:     zone,
+		selector: selector,
+		refresh:  refresh,
+	}
+
+	go r.run(ctx)
+
+	return r
+}
+
+type Resolver struct {
+	sync.Mutex
+	lookup   Lookup
+	project  string
+	zone     string
+	selector Selector
+	refresh  time.Duration
+
+	instances []Instance
+	resolved  bool
+	updated   time.Time
+}
+
+// Instances returns the instances of the last lookup, only looking them up when that didn't happen yet,
+// failed or was invalidated. A lookup matching nothing is kept like any other until the next refresh.
+func (r *Resolver) Instances(ctx context.Context) ([]Instance, error) {
+	r.Lock()
+	if !r.updated.IsZero() {
+		instances := r.instances
+		r.Unlock()
+		return instances, nil
+	}
+	r.Unlock()
+
+	return r.update(ctx)
+}
+
+// run refreshes the instances in the background, so dials see instances coming and going without waiting for a lookup.
+func (r *Resolver) run(ctx context.Context) {
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, _ = r.update(ctx)
+	}
+}
+
+// update looks the instances up without holding the lock, dials keep using the previous result meanwhile.
+func (r *Resolver) update(ctx context.Context) ([]Instance, error) {
+	instances, err := r.lookup.LookupInstances(ctx, r.project, r.zone, r.selector)
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err != nil {
+		// keep using the previous result rather than failing every dial on a lookup hiccup
+		if r.resolved {
+			slog.Warn("Unable to refresh instances, using cached result", "err", err)
+			return r.instances, nil
+		}
+		return nil, err
+	}
+
+	r.instances = instances
+	r.resolved = true
+	r.updated = time.Now()
+
+	return r.instances, nil
+}
+
+func (r *Resolver) Invalidate() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.updated = time.Time{}
+}
@@ -0,0 +1,212 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLookup returns the instances it is given, counting the lookups.
+type fakeLookup struct {
+	sync.Mutex
+	instances []Instance
+	err       error
+	lookups   int
+	selectors []Selector
+}
+
+func (f *fakeLookup) LookupInstances(_ context.Context, project, zone string, selector Selector) ([]Instance, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.lookups++
+	f.selectors = append(f.selectors, selector)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return slices.Clone(f.instances), nil
+}
+
+func (f *fakeLookup) set(instances []Instance, err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.instances, f.err = instances, err
+}
+
+func (f *fakeLookup) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.lookups
+}
+
+func TestResolverLooksUpOnceUntilRefreshed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vm1 := Instance{Project: "p", Zone: "z", Name: "vm-1"}
+	lookup := &fakeLookup{instances: []Instance{vm1}}
+	selector := Selector{Labels: map[string]string{"role": "tunnel"}}
+
+	r := NewResolver(ctx, lookup, "p", "z", selector, time.Hour)
+
+	for range 3 {
+		instances, err := r.Instances(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(instances, []Instance{vm1}) {
+			t.Fatalf("got %v, want %v", instances, []Instance{vm1})
+		}
+	}
+
+	if n := lookup.count(); n != 1 {
+		t.Fatalf("got %d lookups, want 1", n)
+	}
+	if lookup.selectors[0].Labels["role"] != "tunnel" {
+		t.Fatalf("lookup got selector %v, want %v", lookup.selectors[0], selector)
+	}
+}
+
+func TestResolverRefreshesPeriodically(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vm1 := Instance{Project: "p", Zone: "z", Name: "vm-1"}
+	vm2 := Instance{Project: "p", Zone: "z", Name: "vm-2"}
+	lookup := &fakeLookup{instances: []Instance{vm1}}
+
+	r := NewResolver(ctx, lookup, "p", "z", Selector{NamePrefix: "vm-"}, 10*time.Millisecond)
+
+	if _, err := r.Instances(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup.set([]Instance{vm1, vm2}, nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		instances, err := r.Instances(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slices.Equal(instances, []Instance{vm1, vm2}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("instances not refreshed, got %v", instances)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the refresh stops with the context
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	n := lookup.count()
+	time.Sleep(50 * time.Millisecond)
+	if lookup.count() != n {
+		t.Fatal("instances still refreshed after the context is done")
+	}
+}
+
+func TestResolverKeepsInstancesWhenRefreshFails(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vm1 := Instance{Project: "p", Zone: "z", Name: "vm-1"}
+	lookup := &fakeLookup{instances: []Instance{vm1}}
+
+	r := NewResolver(ctx, lookup, "p", "z", Selector{NamePrefix: "vm-"}, 10*time.Millisecond)
+
+	if _, err := r.Instances(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup.set(nil, errors.New("compute api unavailable"))
+	n := lookup.count()
+	for lookup.count() < n+2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	instances, err := r.Instances(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(instances, []Instance{vm1}) {
+		t.Fatalf("got %v, want %v", instances, []Instance{vm1})
+	}
+}
+
+func TestResolverFailsWithoutInstances(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lookup := &fakeLookup{err: errors.New("permission denied")}
+	r := NewResolver(ctx, lookup, "p", "z", Selector{NamePrefix: "vm-"}, time.Hour)
+
+	if _, err := r.Instances(ctx); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// a failed lookup is not cached
+	vm1 := Instance{Project: "p", Zone: "z", Name: "vm-1"}
+	lookup.set([]Instance{vm1}, nil)
+
+	instances, err := r.Instances(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(instances, []Instance{vm1}) {
+		t.Fatalf("got %v, want %v", instances, []Instance{vm1})
+	}
+}
+
+func TestResolverCachesEmptyResult(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lookup := &fakeLookup{}
+	r := NewResolver(ctx, lookup, "p", "z", Selector{NamePrefix: "vm-"}, time.Hour)
+
+	for range 3 {
+		instances, err := r.Instances(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(instances) != 0 {
+			t.Fatalf("got %v, want no instances", instances)
+		}
+	}
+
+	if n := lookup.count(); n != 1 {
+		t.Fatalf("got %d lookups, want 1", n)
+	}
+}
+
+func TestResolverInvalidate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vm1 := Instance{Project: "p", Zone: "z", Name: "vm-1"}
+	vm2 := Instance{Project: "p", Zone: "z", Name: "vm-2"}
+	lookup := &fakeLookup{instances: []Instance{vm1}}
+
+	r := NewResolver(ctx, lookup, "p", "z", Selector{NamePrefix: "vm-"}, time.Hour)
+
+	if _, err := r.Instances(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup.set([]Instance{vm2}, nil)
+	r.Invalidate()
+
+	instances, err := r.Instances(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(instances, []Instance{vm2}) {
+		t.Fatalf("got %v, want %v", instances, []Instance{vm2})
+	}
+}
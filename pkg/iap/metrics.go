@@ -0,0 +1,35 @@
+package iap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jsiebens/cloud-tunnel/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// connects counts every connection to the IAP proxy, IAP has no way to resume one so a tunnel reconnecting opens a new one.
+var connects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metrics.Namespace,
+	Subsystem: "iap",
+	Name:      "connects_total",
+	Help:      "Connections to the IAP proxy, by their result.",
+}, []string{"result"})
+
+func connectResult(err error) string {
+	if err == nil {
+		return "success"
+	}
+
+	var iapErr *Error
+	if errors.As(err, &iapErr) {
+		return fmt.Sprintf("error_%d", int(iapErr.Code))
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return fmt.Sprintf("status_%d", statusErr.StatusCode)
+	}
+
+	return "error"
+}
@@ -0,0 +1,90 @@
+package iap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"golang.org/x/oauth2/google"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// DefaultProject returns the project configured in the environment, the active gcloud configuration or the application default credentials.
+func DefaultProject(ctx context.Context) (string, error) {
+	for _, env := range []string{"CLOUDSDK_CORE_PROJECT", "GOOGLE_CLOUD_PROJECT"} {
+		if project := os.Getenv(env); project != "" {
+			return project, nil
+		}
+	}
+
+	if project := gcloudProject(); project != "" {
+		return project, nil
+	}
+
+	creds, err := google.FindDefaultCredentials(ctx)
+	if err == nil && creds.ProjectID != "" {
+		return creds.ProjectID, nil
+	}
+
+	return "", fmt.Errorf("unable to determine the project, set it explicitly or run 'gcloud config set project'")
+}
+
+func gcloudProject() string {
+	dir := gcloudConfigDir()
+	if dir == "" {
+		return ""
+	}
+
+	name := os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME")
+	if name == "" {
+		content, err := os.ReadFile(filepath.Join(dir, "active_config"))
+		if err != nil {
+			name = "default"
+		} else {
+			name = strings.TrimSpace(string(content))
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "configurations", "config_"+name))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if ok && section == "core" && strings.TrimSpace(key) == "project" {
+			return strings.TrimSpace(value)
+		}
+	}
+
+	return ""
+}
+
+func gcloudConfigDir() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir
+	}
+
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".config", "gcloud")
+}
@@ -0,0 +1,106 @@
+package iap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGcloudProject(t *testing.T) {
+	tests := []struct {
+		name         string
+		activeConfig string
+		activeEnv    string
+		configs      map[string]string
+		want         string
+	}{
+		{
+			name:         "active config",
+			activeConfig: "work\n",
+			configs: map[string]string{
+				"default": "[core]\nproject = personal\n",
+				"work":    "[core]\naccount = me@example.com\nproject = work-project\n",
+			},
+			want: "work-project",
+		},
+		{
+			name:      "active config from the environment",
+			activeEnv: "work",
+			configs: map[string]string{
+				"default": "[core]\nproject = personal\n",
+				"work":    "[core]\nproject = work-project\n",
+			},
+			want: "work-project",
+		},
+		{
+			name:    "default config",
+			configs: map[string]string{"default": "[core]\nproject=personal\n"},
+			want:    "personal",
+		},
+		{
+			name:    "other section",
+			configs: map[string]string{"default": "[compute]\nproject = not-this-one\nzone = europe-west1-b\n\n[core]\naccount = me@example.com\n"},
+		},
+		{
+			name: "no config",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("CLOUDSDK_CONFIG", dir)
+			t.Setenv("CLOUDSDK_ACTIVE_CONFIG_NAME", tt.activeEnv)
+
+			if tt.activeConfig != "" {
+				if err := os.WriteFile(filepath.Join(dir, "active_config"), []byte(tt.activeConfig), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.MkdirAll(filepath.Join(dir, "configurations"), 0o700); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range tt.configs {
+				if err := os.WriteFile(filepath.Join(dir, "configurations", "config_"+name), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := gcloudProject(); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultProjectFromEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CLOUDSDK_CONFIG", dir)
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "from-env")
+	t.Setenv("CLOUDSDK_CORE_PROJECT", "")
+
+	if err := os.MkdirAll(filepath.Join(dir, "configurations"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "configurations", "config_default"), []byte("[core]\nproject = from-gcloud\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	project, err := DefaultProject(context.Background())
+	if err != nil || project != "from-env" {
+		t.Fatalf("got %q, %v, want from-env", project, err)
+	}
+
+	// gcloud's own override goes first
+	t.Setenv("CLOUDSDK_CORE_PROJECT", "from-sdk-env")
+	if project, _ := DefaultProject(context.Background()); project != "from-sdk-env" {
+		t.Fatalf("got %q, want from-sdk-env", project)
+	}
+
+	t.Setenv("CLOUDSDK_CORE_PROJECT", "")
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "")
+	if project, _ := DefaultProject(context.Background()); project != "from-gcloud" {
+		t.Fatalf("got %q, want from-gcloud", project)
+	}
+}
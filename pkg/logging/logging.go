@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	// FormatGCP is JSON with the fields Cloud Logging picks up as the severity and the message of an entry
+	FormatGCP = "gcp"
+)
+
+// Setup configures the default logger, all logs are written to stderr.
+func Setup(level, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unsupported log level '%s'", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+
+	switch format {
+	case FormatText:
+		// the default logger keeps the format of the log package
+		slog.SetLogLoggerLevel(l)
+	case FormatJSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	case FormatGCP:
+		opts.ReplaceAttr = gcpAttr
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("unsupported log format '%s'", format)
+	}
+
+	return nil
+}
+
+// gcpAttr renames the level and message, see https://cloud.google.com/logging/docs/structured-logging#special-payload-fields
+func gcpAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+
+	switch a.Key {
+	case slog.LevelKey:
+		if l, ok := a.Value.Any().(slog.Level); ok {
+			return slog.String("severity", severity(l))
+		}
+	case slog.MessageKey:
+		a.Key = "message"
+	}
+
+	return a
+}
+
+func severity(l slog.Level) string {
+	switch {
+	case l >= slog.LevelError:
+		return "ERROR"
+	case l >= slog.LevelWarn:
+		return "WARNING"
+	case l >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+const Namespace = "cloud_tunnel"
+
+// Start serves the metrics of the default registry at /metrics in the background.
+func Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	slog.Info(fmt.Sprintf("Serving metrics on %s", addr))
+
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("Unable to serve metrics", "err", err)
+		}
+	}()
+
+	return nil
+}
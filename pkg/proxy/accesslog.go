@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"time"
+)
+
+// clientID matches the connection IDs clients may pass on, like the ones generated by newConnectionID.
+var clientID = regexp.MustCompile(`^[0-9a-f]{1,32}$`)
+
+// AccessLog writes a record for every tunnelled connection once it is closed, to a file or to stdout when the path is "-".
+type AccessLog struct {
+	Path string `yaml:"path"`
+	// Format is either json or logfmt
+	Format string `yaml:"format"`
+}
+
+// logger returns the logger writing the access log, or nil when there is no access log.
+func (c AccessLog) logger() (*slog.Logger, error) {
+	if c.Path == "" {
+		return nil, nil
+	}
+
+	var w io.Writer = os.Stdout
+	if c.Path != "-" {
+		f, err := os.OpenFile(c.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	switch c.Format {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	case "logfmt":
+		return slog.New(slog.NewTextHandler(w, nil)), nil
+	default:
+		return nil, fmt.Errorf("unsupported access log format '%s'", c.Format)
+	}
+}
+
+// accessRecord is what the access log knows about a connection before it is closed.
+type accessRecord struct {
+	id        string
+	clientID  string
+	principal string
+	source    string
+	target    string
+	rule      string
+	mode      string
+	transport string
+	start     time.Time
+}
+
+// newAccessRecord returns the record of a new connection, identified like the client identified it when it passed on
+// a valid ID of its own and with an ID generated by the server otherwise.
+func newAccessRecord(id string) *accessRecord {
+	if !clientID.MatchString(id) {
+		return &accessRecord{id: newConnectionID(), start: time.Now()}
+	}
+	return &accessRecord{id: id, clientID: id, start: time.Now()}
+}
+
+// log writes the record to the access log, if there is one. Bytes up are those sent to the upstream, bytes down those received from it.
+func (r *accessRecord) log(l *slog.Logger, reason string, up, down int64) {
+	if l == nil {
+		return
+	}
+
+	l.Info("connection",
+		"id", r.id,
+		"client_id", r.clientID,
+		"principal", r.principal,
+		"source", r.source,
+		"target", r.target,
+		"rule", r.rule,
+		"mode", r.mode,
+		"transport", r.transport,
+		"bytes_up", up,
+		"bytes_down", down,
+		"duration_ms", time.Since(r.start).Milliseconds(),
+		"reason", reason,
+	)
+}
+
+func newConnectionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
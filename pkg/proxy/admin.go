@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Admin serves the API listing and terminating the open connections:
+//
+//	GET    /connections[?principal=...]  lists the open connections
+//	DELETE /connections/{id}             terminates a connection
+//	DELETE /connections?principal=...    terminates all connections of a principal
+type Admin struct {
+	ListenAddr string `yaml:"listen_addr"`
+	// Token is the bearer token clients of the API have to present
+	Token string `yaml:"token"`
+}
+
+// start serves the admin API in the background, if it has a listen address.
+func (a Admin) start(conns *registry, tokenRequired bool) error {
+	if a.ListenAddr == "" {
+		return nil
+	}
+
+	if tokenRequired && a.Token == "" {
+		return errors.New("the admin api requires a token")
+	}
+
+	ln, err := net.Listen("tcp", a.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	// without a token anyone able to reach the api can terminate connections, so only local processes may
+	if addr, ok := ln.Addr().(*net.TCPAddr); a.Token == "" && (!ok || !addr.IP.IsLoopback()) {
+		_ = ln.Close()
+		return fmt.Errorf("the admin api requires a token when listening on %s, which is not a loopback address", a.ListenAddr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, conns.list(req.URL.Query().Get("principal")))
+	})
+	mux.HandleFunc("DELETE /connections", func(w http.ResponseWriter, req *http.Request) {
+		principal := req.URL.Query().Get("principal")
+		if principal == "" {
+			http.Error(w, "missing principal", http.StatusBadRequest)
+			return
+		}
+		n := conns.terminatePrincipal(principal)
+		slog.Info("Terminated connections", "principal", principal, "count", n)
+		writeJSON(w, map[string]int{"terminated": n})
+	})
+	mux.HandleFunc("DELETE /connections/{id}", func(w http.ResponseWriter, req *http.Request) {
+		id := req.PathValue("id")
+		if conns.terminate(id) == 0 {
+			http.Error(w, "connection not found", http.StatusNotFound)
+			return
+		}
+		slog.Info("Terminated connection", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	slog.Info(fmt.Sprintf("Admin API listening on %s", a.ListenAddr))
+
+	go func() {
+		if err := http.Serve(ln, a.authenticate(mux)); err != nil {
+			slog.Error("Admin API stopped", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+func (a Admin) authenticate(next http.Handler) http.Handler {
+	if a.Token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const controlSocketExt = ".sock"
+
+// ControlSocketDir is where client processes create their control socket by default, see DefaultControlSocket.
+func ControlSocketDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("cloud-tunnel-%d", os.Getuid()))
+}
+
+// DefaultControlSocket returns the control socket of this process, unique for every command running.
+func DefaultControlSocket(command string) string {
+	return filepath.Join(ControlSocketDir(), fmt.Sprintf("%s-%d%s", command, os.Getpid(), controlSocketExt))
+}
+
+// ControlSockets returns the control sockets in the default directory, removing those of processes no longer running.
+func ControlSockets() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(ControlSocketDir(), "*"+controlSocketExt))
+	if err != nil {
+		return nil, err
+	}
+
+	var sockets []string
+	for _, p := range paths {
+		conn, err := net.Dial("unix", p)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			_ = os.Remove(p)
+			continue
+		}
+		if err == nil {
+			_ = conn.Close()
+		}
+		sockets = append(sockets, p)
+	}
+
+	return sockets, nil
+}
+
+// ReadStatus asks the client process listening on the control socket for its status.
+func ReadStatus(ctx context.Context, socket string) (*Status, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://control/status", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	s := &Status{}
+	if err := json.NewDecoder(resp.Body).Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// serveControl serves the status of the process on the control socket in the background, if there is one,
+// returning a func to stop serving and remove the socket.
+func (t *tracker) serveControl(socket string) (func(), error) {
+	if socket == "" {
+		return func() {}, nil
+	}
+
+	dir := filepath.Dir(socket)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if dir == ControlSocketDir() {
+		if err := checkControlDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	_ = os.Remove(socket)
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, t.status())
+	})
+
+	slog.Debug("Serving control socket", "path", socket)
+
+	go func() {
+		if err := http.Serve(ln, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("Control socket stopped", "err", err)
+		}
+	}()
+
+	return func() { _ = ln.Close() }, nil
+}
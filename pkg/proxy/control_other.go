@@ -0,0 +1,8 @@
+//go:build !unix
+
+package proxy
+
+// checkControlDir has nothing to check without unix ownership and modes, the temp directory is per user already.
+func checkControlDir(string) error {
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkControlDir refuses a default control socket directory another user got to create first in the shared temp directory.
+func checkControlDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !info.IsDir():
+		return fmt.Errorf("control socket directory %s is not a directory", dir)
+	case info.Mode().Perm() != 0o700:
+		return fmt.Errorf("control socket directory %s has mode %#o, want 0700", dir, info.Mode().Perm())
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("control socket directory %s is owned by uid %d, not by the current user", dir, stat.Uid)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build unix
+
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckControlDir(t *testing.T) {
+	dir := t.TempDir()
+
+	private := filepath.Join(dir, "private")
+	if err := os.Mkdir(private, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkControlDir(private); err != nil {
+		t.Fatal(err)
+	}
+
+	shared := filepath.Join(dir, "shared")
+	if err := os.Mkdir(shared, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(shared, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkControlDir(shared); err == nil {
+		t.Fatal("expected a directory readable by others to be refused")
+	}
+
+	// a symlink is refused, even to a directory that would do
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(private, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkControlDir(link); err == nil {
+		t.Fatal("expected a symlink to be refused")
+	}
+}
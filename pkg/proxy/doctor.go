@@ -0,0 +1,402 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jsiebens/cloud-tunnel/pkg/iap"
+	"github.com/jsiebens/cloud-tunnel/pkg/remotedialer"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// doctorProbeTimeout is how long a tunnel has to stay open for the server to be considered to have dialed its upstream,
+// the server only closes it right away when it couldn't.
+const doctorProbeTimeout = 2 * time.Second
+
+const (
+	CheckOK      = "ok"
+	CheckWarning = "warning"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+type DoctorConfig struct {
+	Tunnel
+	// Upstream is dialed through the tunnel as the last check, which is skipped when it is empty
+	Upstream string
+	// Timeout bounds every check
+	Timeout time.Duration
+}
+
+// Check is the outcome of one step of the diagnosis, with a hint on how to fix it when it didn't succeed.
+type Check struct {
+	Name   string
+	Result string
+	Detail string
+	Hint   string
+}
+
+type doctor struct {
+	c         DoctorConfig
+	ts        oauth2.TokenSource
+	token     *oauth2.Token
+	instance  iap.Instance
+	principal string
+}
+
+var errDoctorFailed = errors.New("the tunnel is not working")
+
+// Doctor steps through every layer a tunnel depends on, reporting each check as it completes. Once a check fails,
+// the ones depending on it are skipped and an error is returned.
+func Doctor(ctx context.Context, c DoctorConfig, report func(Check)) error {
+	if !c.configured() {
+		return errors.New("either a service url, an instance or an instance selector is required")
+	}
+
+	d := &doctor{c: c}
+
+	return runSteps(ctx, c.Timeout, []doctorStep{
+		{"credentials", d.checkCredentials},
+		{"token", d.checkToken},
+		{"transport", d.checkTransport},
+		{"server health", d.checkHealth},
+		{"upstream dial", d.checkUpstream},
+	}, report)
+}
+
+type doctorStep struct {
+	name string
+	run  func(ctx context.Context) Check
+}
+
+// runSteps runs the steps in order, skipping every step after one that failed.
+func runSteps(ctx context.Context, timeout time.Duration, steps []doctorStep, report func(Check)) error {
+	ok := true
+	for _, step := range steps {
+		if !ok {
+			report(Check{Name: step.name, Result: CheckSkipped})
+			continue
+		}
+
+		stepCtx, cancel := context.WithTimeout(ctx, timeout)
+		check := step.run(stepCtx)
+		cancel()
+
+		check.Name = step.name
+		report(check)
+		ok = check.Result != CheckFailed
+	}
+
+	if !ok {
+		return errDoctorFailed
+	}
+	return nil
+}
+
+func (d *doctor) checkCredentials(ctx context.Context) Check {
+	creds, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	if err != nil {
+		return failed(err, "run 'gcloud auth application-default login' or point GOOGLE_APPLICATION_CREDENTIALS to a service account key")
+	}
+
+	var file struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+	}
+	_ = json.Unmarshal(creds.JSON, &file)
+
+	detail := "application default credentials from the metadata server"
+	switch {
+	case file.ClientEmail != "":
+		detail = fmt.Sprintf("application default credentials of type %s for %s", file.Type, file.ClientEmail)
+	case file.Type != "":
+		detail = fmt.Sprintf("application default credentials of type %s", file.Type)
+	}
+
+	if d.c.ServiceAccount != "" {
+		detail += ", impersonating " + d.c.ServiceAccount
+	}
+
+	return Check{Result: CheckOK, Detail: detail}
+}
+
+func (d *doctor) checkToken(ctx context.Context) Check {
+	impersonationHint := ""
+	if d.c.ServiceAccount != "" {
+		impersonationHint = fmt.Sprintf("grant the caller roles/iam.serviceAccountTokenCreator on %s", d.c.ServiceAccount)
+	}
+
+	var err error
+	if d.c.ServiceUrl != "" {
+		d.ts, err = idTokenSource(ctx, d.c.ServiceUrl, d.c.ServiceAccount)
+	} else {
+		d.ts, err = tokenSource(ctx, d.c.ServiceAccount)
+	}
+	if err != nil {
+		return failed(err, impersonationHint)
+	}
+
+	if d.token, err = d.ts.Token(); err != nil {
+		return failed(err, impersonationHint)
+	}
+
+	expires := fmt.Sprintf("expires in %s", time.Until(d.token.Expiry).Round(time.Second))
+
+	// access tokens are opaque, only the ID tokens for Cloud Run can be inspected
+	if d.c.ServiceUrl == "" {
+		return Check{Result: CheckOK, Detail: "access token " + expires}
+	}
+
+	d.principal = remotedialer.Principal("Bearer " + d.token.AccessToken)
+	detail := fmt.Sprintf("ID token for %s, %s", d.principal, expires)
+
+	if aud := audience(d.token.AccessToken); aud != d.c.ServiceUrl {
+		return Check{
+			Result: CheckWarning,
+			Detail: fmt.Sprintf("%s, with audience %s instead of %s", detail, aud, d.c.ServiceUrl),
+			Hint:   "user credentials can't mint ID tokens for the service url, use --service-account or add the audience to the custom audiences of the service if it is refused",
+		}
+	}
+
+	return Check{Result: CheckOK, Detail: detail}
+}
+
+func (d *doctor) checkTransport(ctx context.Context) Check {
+	check := d.connect(ctx)
+	if check.Result != CheckOK {
+		return check
+	}
+
+	return d.handshake(ctx, check.Detail)
+}
+
+// connect checks the server, or the IAP proxy in front of it, can be reached.
+func (d *doctor) connect(ctx context.Context) Check {
+	if d.c.ServiceUrl != "" {
+		u, err := url.Parse(d.c.ServiceUrl)
+		if err != nil {
+			return failed(err, "check the service url")
+		}
+
+		conn, err := d.dialService(ctx, u)
+		if err != nil {
+			return failed(err, fmt.Sprintf("check the service url and that %s can be reached from this network", u.Host))
+		}
+		defer conn.Close()
+
+		return Check{Result: CheckOK, Detail: "connected to " + conn.RemoteAddr().String()}
+	}
+
+	instances, err := d.c.instances(ctx, d.ts)
+	if err != nil {
+		return failed(err, "check the instance, project and zone, and that the caller has roles/compute.viewer")
+	}
+
+	found, err := instances.Instances(ctx)
+	if errors.Is(err, iap.ErrInstanceNotRunning) {
+		return failed(err, "start the instance, or check the instance name and project")
+	}
+	if err != nil {
+		return failed(err, "check the instance, project and zone, and that the caller has roles/compute.viewer")
+	}
+	if len(found) == 0 {
+		return failed(errors.New("no instances found"), "check the instance selector and that the instances are running")
+	}
+	d.instance = found[0]
+
+	conn, err := d.dialInstance(ctx)
+	if err != nil {
+		return failed(err, remotedialer.Hint(err))
+	}
+	defer conn.Close()
+
+	return Check{Result: CheckOK, Detail: fmt.Sprintf("connected through IAP to %s", conn.RemoteAddr())}
+}
+
+// handshake opens a tunnel the way the proxy does, without upstream, so refusals of the ingress of the service
+// or of the server are reported for the transport rather than when dialing the upstream.
+func (d *doctor) handshake(ctx context.Context, detail string) Check {
+	dialer, err := d.c.dialer(ctx, newTracker("doctor", "").addRule(nil))
+	if err != nil {
+		return failed(err, "")
+	}
+	defer remotedialer.Close(dialer)
+
+	transport := cmp.Or(d.c.Transport, string(remotedialer.UpgradeTransport))
+
+	err = remotedialer.Probe(ctx, dialer)
+
+	var statusErr *remotedialer.StatusError
+	switch {
+	case err == nil:
+		return Check{Result: CheckOK, Detail: fmt.Sprintf("%s, %s tunnel accepted", detail, transport)}
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusBadRequest:
+		return Check{
+			Result: CheckWarning,
+			Detail: fmt.Sprintf("%s, %s tunnel without upstream refused: %s", detail, transport, err),
+			Hint:   "upgrade the cloud-tunnel server to a version accepting tunnels without upstream",
+		}
+	case errors.As(err, &statusErr):
+		return failed(err, d.statusHint(statusErr.StatusCode))
+	}
+
+	return failed(err, remotedialer.Hint(err))
+}
+
+// checkHealth asks the server for its health on /health, as Cloud Run doesn't pass /healthz on to services.
+func (d *doctor) checkHealth(ctx context.Context) Check {
+	target := "http://server/health"
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) { return d.dialInstance(ctx) }
+
+	if d.c.ServiceUrl != "" {
+		target = strings.TrimSuffix(d.c.ServiceUrl, "/") + "/health"
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return failed(err, "")
+	}
+	if d.c.ServiceUrl != "" {
+		req.Header.Set(remotedialer.AuthorizationHeaderName, "Bearer "+d.token.AccessToken)
+	}
+
+	client := &http.Client{Transport: &http.Transport{DialContext: dial, DisableKeepAlives: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return failed(err, "make sure the cloud-tunnel server is running and listening on the port")
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return Check{Result: CheckOK, Detail: "server is healthy"}
+	case http.StatusBadRequest, http.StatusNotFound:
+		// the transport check already got through the ingress, older servers refuse the request as a tunnel without upstream
+		return Check{Result: CheckWarning, Detail: "the server has no health endpoint", Hint: "upgrade the cloud-tunnel server to a version serving /health"}
+	}
+
+	return failed(fmt.Errorf("server answered %s", resp.Status), d.statusHint(resp.StatusCode))
+}
+
+// statusHint returns how to fix the server, or the service in front of it, answering with the status code.
+func (d *doctor) statusHint(code int) string {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		caller := "the caller"
+		if d.principal != "" {
+			caller = d.principal
+		}
+		return fmt.Sprintf("grant %s roles/run.invoker on the service", caller)
+	case http.StatusNotFound:
+		return "check the service url, and that the ingress settings of the service allow traffic from this network"
+	}
+	return ""
+}
+
+func (d *doctor) checkUpstream(ctx context.Context) Check {
+	if d.c.Upstream == "" {
+		return Check{Result: CheckSkipped, Detail: "no upstream given", Hint: "use --upstream to test a dial through the tunnel"}
+	}
+
+	dialer, err := d.c.dialer(ctx, newTracker("doctor", "").addRule(nil))
+	if err != nil {
+		return failed(err, "")
+	}
+	defer remotedialer.Close(dialer)
+
+	conn, err := dialer.DialContext(ctx, "tcp", d.c.Upstream)
+	if err != nil {
+		return failed(err, upstreamHint(err, d.c.Upstream))
+	}
+	defer conn.Close()
+
+	// the server may accept the tunnel before dialing the upstream, closing it when that fails
+	_ = conn.SetReadDeadline(time.Now().Add(doctorProbeTimeout))
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return failed(fmt.Errorf("tunnel closed by the server: %w", err), fmt.Sprintf("make sure %s is listening and reachable from the network of the server", d.c.Upstream))
+	}
+
+	return Check{Result: CheckOK, Detail: "tunnel to " + d.c.Upstream + " is open"}
+}
+
+func (d *doctor) dialService(ctx context.Context, u *url.URL) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	if u.Scheme == "https" {
+		return (&tls.Dialer{}).DialContext(ctx, "tcp", host)
+	}
+	return (&net.Dialer{}).DialContext(ctx, "tcp", host)
+}
+
+func (d *doctor) dialInstance(ctx context.Context) (net.Conn, error) {
+	port := d.c.Port
+	if port == 0 {
+		port = remotedialer.DefaultServerPort
+	}
+
+	return iap.Dial(ctx, d.ts, iap.DialOptions{
+		Project:  d.instance.Project,
+		Zone:     d.instance.Zone,
+		Instance: d.instance.Name,
+		Port:     port,
+	})
+}
+
+func upstreamHint(err error, upstream string) string {
+	var statusErr *remotedialer.StatusError
+	var upstreamErr *remotedialer.UpstreamError
+	switch {
+	case errors.Is(err, remotedialer.ErrUpstreamNotAllowed),
+		errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusForbidden:
+		return fmt.Sprintf("add %s to the allowed upstreams of the server", upstream)
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests:
+		return "the limits of the server were exceeded, try again later or raise them"
+	case errors.As(err, &upstreamErr):
+		return fmt.Sprintf("make sure %s is listening and reachable from the network of the server", upstream)
+	}
+	return remotedialer.Hint(err)
+}
+
+// audience returns the audience of an ID token, without verifying it.
+func audience(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	var claims struct {
+		Audience string `json:"aud"`
+	}
+	_ = json.Unmarshal(payload, &claims)
+	return claims.Audience
+}
+
+func failed(err error, hint string) Check {
+	return Check{Result: CheckFailed, Detail: err.Error(), Hint: hint}
+}
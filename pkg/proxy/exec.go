@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/term"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// defaultNoProxy keeps the child from sending local traffic to the proxy.
+var defaultNoProxy = []string{"localhost", "127.0.0.1", "::1"}
+
+// ExitError is returned by Exec when the command exits with a non-zero status, the code being 128 plus the signal
+// number when it was killed by a signal.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// Exec runs the command with the proxy environment variables pointing to a proxy of its own on an ephemeral
+// local port, forwarding signals to the command and stopping the proxy once it exits.
+func Exec(ctx context.Context, c ProxyConfig, noProxy []string, name string, args ...string) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	// the command only starts once the proxy is set up, it would run without one otherwise
+	p, err := newProxy(ctx, ln, c)
+	if err != nil {
+		_ = ln.Close()
+		return err
+	}
+	defer p.close()
+
+	proxyErrs := make(chan error, 1)
+	go func() { proxyErrs <- p.serve() }()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = proxyEnv(os.Environ(), ln.Addr().String(), noProxy)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		_ = ln.Close()
+		<-proxyErrs
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	for {
+		select {
+		case sig := <-signals:
+			// a terminal sends these to the whole foreground process group, the command already got them
+			if (sig == os.Interrupt || sig == syscall.SIGQUIT) && term.IsTerminal(int(os.Stdin.Fd())) {
+				continue
+			}
+			_ = cmd.Process.Signal(sig)
+		case err := <-proxyErrs:
+			_ = cmd.Process.Kill()
+			<-done
+			return fmt.Errorf("proxy stopped: %w", err)
+		case err := <-done:
+			// the proxy is done once its listener is closed
+			_ = ln.Close()
+			<-proxyErrs
+			return exitError(err)
+		}
+	}
+}
+
+// proxyEnv returns the environment with the proxy variables, in both cases as not all tools read the same ones.
+func proxyEnv(environ []string, addr string, noProxy []string) []string {
+	noProxy = slices.Concat(defaultNoProxy, noProxy)
+
+	vars := map[string]string{
+		"HTTP_PROXY":  "http://" + addr,
+		"HTTPS_PROXY": "http://" + addr,
+		"ALL_PROXY":   "socks5://" + addr,
+	}
+
+	var env []string
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		switch upper := strings.ToUpper(k); {
+		case upper == "NO_PROXY":
+			if v != "" {
+				noProxy = append(noProxy, v)
+			}
+		case vars[upper] != "":
+		default:
+			env = append(env, kv)
+		}
+	}
+
+	vars["NO_PROXY"] = strings.Join(noProxy, ",")
+	for k, v := range vars {
+		env = append(env, k+"="+v, strings.ToLower(k)+"="+v)
+	}
+
+	return env
+}
+
+func exitError(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return &ExitError{Code: 128 + int(ws.Signal())}
+	}
+	return &ExitError{Code: exitErr.ExitCode()}
+}
@@ -4,65 +4,62 @@ import (
 	"context"
 	"fmt"
 	"github.com/jsiebens/cloud-tunnel/pkg/remotedialer"
+	"github.com/jsiebens/cloud-tunnel/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
 	"net"
-	"net/url"
+	"time"
 )
 
 type TcpForwardConfig struct {
-	ServiceUrl     string
-	ServiceAccount string
-	Instance       string
-	Port           int
-	Project        string
-	Zone           string
-	Upstream       string
-	MuxEnabled     bool
+	Tunnel
+	Upstream  string
+	Timeouts  Timeouts
+	AccessLog AccessLog
+	// ControlSocket is the unix socket the status of the forward is served on
+	ControlSocket string
 }
 
 func StartTcpForward(ctx context.Context, addr string, c TcpForwardConfig) error {
-	// cloud run
-	if c.ServiceUrl != "" {
-		u, err := url.Parse(c.ServiceUrl)
-		if err != nil {
-			return err
-		}
-
-		ts, err := idTokenSource(ctx, c.ServiceUrl, c.ServiceAccount)
-		if err != nil {
-			return err
-		}
+	status := newTracker("tcp-forward", addr)
 
-		p := tcpForward{
-			addr:     addr,
-			upstream: c.Upstream,
-			dialer:   remotedialer.RemoteDialer(ts, u, c.MuxEnabled),
-		}
-
-		return p.start()
+	dialer, err := c.dialer(ctx, status.addRule([]string{c.Upstream}))
+	if err != nil {
+		return err
 	}
+	defer remotedialer.Close(dialer)
 
-	// iap
-	{
-		ts, err := tokenSource(ctx, c.ServiceAccount)
-		if err != nil {
-			return err
-		}
+	accessLog, err := c.AccessLog.logger()
+	if err != nil {
+		return err
+	}
 
-		p := tcpForward{
-			addr:     addr,
-			upstream: c.Upstream,
-			dialer:   remotedialer.IAPRemoteDialer(ts, c.Instance, c.Port, c.Project, c.Zone, c.MuxEnabled),
-		}
+	stop, err := status.serveControl(c.ControlSocket)
+	if err != nil {
+		return err
+	}
+	defer stop()
 
-		return p.start()
+	p := tcpForward{
+		addr:      addr,
+		upstream:  c.Upstream,
+		dialer:    dialer,
+		timeouts:  c.Timeouts,
+		accessLog: accessLog,
+		status:    status,
 	}
+
+	return p.start()
 }
 
 type tcpForward struct {
-	addr     string
-	upstream string
-	dialer   remotedialer.Dialer
+	addr      string
+	upstream  string
+	dialer    remotedialer.Dialer
+	timeouts  Timeouts
+	accessLog *slog.Logger
+	status    *tracker
 }
 
 func (tp *tcpForward) start() error {
@@ -85,11 +82,40 @@ func (tp *tcpForward) start() error {
 
 func (tp *tcpForward) handleConnection(conn net.Conn) {
 	defer conn.Close()
-	dst, err := tp.dialer.DialContext(context.Background(), "tcp", tp.upstream)
+
+	record := newAccessRecord("")
+	record.source = conn.RemoteAddr().String()
+	record.target = tp.upstream
+	record.mode = "remote"
+
+	ctx, span := tracer.Start(context.Background(), "forward.accept", trace.WithAttributes(
+		attribute.String("tunnel.upstream", tp.upstream),
+		attribute.String("tunnel.connection_id", record.id),
+	))
+
+	info := &remotedialer.DialInfo{ConnectionID: record.id}
+
+	start := time.Now()
+	dst, err := tp.dialer.DialContext(remotedialer.WithDialInfo(ctx, info), "tcp", tp.upstream)
+	proxyDials.WithLabelValues(tp.upstream, "remote", dialResult(err)).Inc()
+	proxyDialDuration.WithLabelValues(tp.upstream, "remote").Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
+	tp.status.observe(tp.upstream, tp.upstream, err)
+
+	record.transport, record.principal = string(info.Transport), info.Principal
+
 	if err != nil {
-		slog.Error("Unable to dial upstream", "addr", tp.upstream, "err", err)
+		logDialError("Unable to dial upstream", tp.upstream, err)
+		record.log(tp.accessLog, closeReasonDialError, 0, 0)
 		return
 	}
-	slog.Info("Dialed remote upstream", "addr", tp.upstream)
-	pipe(conn, dst)
+	slog.Info("Dialed remote upstream", "addr", tp.upstream, "id", record.id)
+	m := meter(dst, proxyBytes, tp.upstream, proxyConnections.WithLabelValues("remote"))
+	m.record = record
+	tp.status.conns.add(m)
+
+	stats := pipe(conn, m, tp.timeouts)
+	stats.reason = m.closeReason(stats.reason)
+	record.log(tp.accessLog, stats.reason, stats.up, stats.down)
+	slog.Info("Closed remote upstream", append([]any{"addr", tp.upstream}, stats.attrs()...)...)
 }
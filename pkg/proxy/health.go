@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/jsiebens/cloud-tunnel/internal/version"
+	"github.com/jsiebens/cloud-tunnel/pkg/remotedialer"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const drainPollInterval = 500 * time.Millisecond
+
+var errDraining = errors.New("draining")
+
+// serveHealth answers health checks, version requests and anything else not carrying the headers of a tunnel,
+// returning false for tunnel requests. Cloud Run reserves /healthz, so health checks through it go to /health.
+func (s *tunnelServer) serveHealth(w http.ResponseWriter, req *http.Request) bool {
+	if req.Header.Get(remotedialer.UpstreamHeaderName) != "" || req.Header.Get(remotedialer.DeferredHeaderName) != "" {
+		return false
+	}
+
+	switch req.URL.Path {
+	case "/health", "/healthz":
+		_, _ = w.Write([]byte("ok\n"))
+	case "/readyz":
+		if err := s.ready(req.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return true
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	case "/version":
+		v, rev := version.GetReleaseInfo()
+		writeJSON(w, map[string]string{"version": v, "revision": rev})
+	default:
+		return false
+	}
+
+	return true
+}
+
+// ready reports why the server should not get new tunnels, if it shouldn't.
+func (s *tunnelServer) ready(ctx context.Context) error {
+	if s.draining.Load() {
+		return errDraining
+	}
+
+	if s.readinessProbe == "" {
+		return nil
+	}
+
+	conn, err := s.probeDialer.DialContext(ctx, "tcp", s.readinessProbe)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// drain fails the readiness checks, refuses new tunnels and stops accepting connections, then waits for the open
+// tunnels to be closed. Those still open when the timeout expires are terminated.
+func (s *tunnelServer) drain(listener io.Closer, timeout time.Duration) {
+	s.draining.Store(true)
+	_ = listener.Close()
+	slog.Info("Draining", "active", s.limiter.count(), "timeout", timeout)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		active := s.limiter.count()
+		if active == 0 {
+			return
+		}
+
+		if !time.Now().Before(deadline) {
+			slog.Warn("Drain timeout expired, closing open tunnels", "active", active)
+			s.conns.terminateAll(s.conns.find(func(*meteredConn) bool { return true }))
+			return
+		}
+
+		time.Sleep(min(drainPollInterval, time.Until(deadline)))
+	}
+}
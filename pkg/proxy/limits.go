@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"github.com/jsiebens/cloud-tunnel/pkg/remotedialer"
+	"golang.org/x/time/rate"
+	"math"
+	"sync"
+	"time"
+)
+
+// minBandwidthBurst allows a full read buffer through at once, even for low bandwidth limits.
+const minBandwidthBurst = 32 * 1024
+
+// principalSweepInterval is how often principals without tunnels and with their rates back at the start are forgotten.
+const principalSweepInterval = time.Minute
+
+// Limits caps what clients of the server may use, zero meaning no limit. Per principal limits only apply
+// to tunnels opened with an ID token, see remotedialer.Principal. The server doesn't verify that token, so these
+// limits only hold when something in front of it does, like Cloud Run, as anyone else may pick a principal of their own.
+type Limits struct {
+	MaxConnections             int `yaml:"max_connections"`
+	MaxConnectionsPerPrincipal int `yaml:"max_connections_per_principal"`
+	// MaxStreamsPerSession caps the tunnels of a single client connecting in mux mode
+	MaxStreamsPerSession int `yaml:"max_streams_per_session"`
+	// DialRate is the number of new tunnels per second
+	DialRate             float64 `yaml:"dial_rate"`
+	DialRatePerPrincipal float64 `yaml:"dial_rate_per_principal"`
+	// Bandwidth is the number of bytes per second copied over a tunnel, in both directions together
+	Bandwidth             int `yaml:"bandwidth"`
+	BandwidthPerPrincipal int `yaml:"bandwidth_per_principal"`
+}
+
+func newLimiter(l Limits) *limiter {
+	return &limiter{
+		limits:     l,
+		dials:      newDialLimiter(l.DialRate),
+		principals: make(map[string]*principalLimiter),
+		now:        time.Now,
+	}
+}
+
+type limiter struct {
+	sync.Mutex
+	limits     Limits
+	active     int
+	dials      *rate.Limiter
+	principals map[string]*principalLimiter
+	swept      time.Time
+	now        func() time.Time
+}
+
+type principalLimiter struct {
+	active    int
+	dials     *rate.Limiter
+	bandwidth *rate.Limiter
+}
+
+// lease is held for as long as a tunnel is open.
+type lease struct {
+	principal string
+	release   func()
+	bandwidth []*rate.Limiter
+}
+
+// acquire admits a new tunnel for the principal, or returns remotedialer.ErrLimitExceeded when that would exceed a limit.
+func (l *limiter) acquire(principal string) (*lease, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.limits.MaxConnections > 0 && l.active >= l.limits.MaxConnections {
+		return nil, remotedialer.ErrLimitExceeded
+	}
+
+	now := l.now()
+	if now.Sub(l.swept) >= principalSweepInterval {
+		l.sweep(now)
+	}
+
+	var p *principalLimiter
+	if principal != "" {
+		p = l.principal(principal)
+		if l.limits.MaxConnectionsPerPrincipal > 0 && p.active >= l.limits.MaxConnectionsPerPrincipal {
+			return nil, remotedialer.ErrLimitExceeded
+		}
+	}
+
+	dials := []*rate.Limiter{l.dials}
+	if p != nil {
+		dials = append(dials, p.dials)
+	}
+	if !reserve(now, dials...) {
+		return nil, remotedialer.ErrLimitExceeded
+	}
+
+	l.active++
+	if p != nil {
+		p.active++
+	}
+
+	lease := &lease{principal: principal}
+
+	var once sync.Once
+	lease.release = func() {
+		once.Do(func() {
+			l.Lock()
+			defer l.Unlock()
+			l.active--
+			if p != nil {
+				p.active--
+			}
+		})
+	}
+
+	if l.limits.Bandwidth > 0 {
+		lease.bandwidth = append(lease.bandwidth, newBandwidthLimiter(l.limits.Bandwidth))
+	}
+	if p != nil && p.bandwidth != nil {
+		lease.bandwidth = append(lease.bandwidth, p.bandwidth)
+	}
+
+	return lease, nil
+}
+
+// count returns the number of open tunnels.
+func (l *limiter) count() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.active
+}
+
+// principal returns the limiter of the principal, which is kept so its rates apply across all its tunnels, past and present.
+func (l *limiter) principal(principal string) *principalLimiter {
+	p, ok := l.principals[principal]
+	if !ok {
+		p = &principalLimiter{dials: newDialLimiter(l.limits.DialRatePerPrincipal)}
+		if l.limits.BandwidthPerPrincipal > 0 {
+			p.bandwidth = newBandwidthLimiter(l.limits.BandwidthPerPrincipal)
+		}
+		l.principals[principal] = p
+	}
+	return p
+}
+
+// sweep forgets the principals without tunnels whose limiters are full again, as a new limiter would be the same.
+func (l *limiter) sweep(now time.Time) {
+	l.swept = now
+	for principal, p := range l.principals {
+		if p.active == 0 && full(p.dials, now) && (p.bandwidth == nil || full(p.bandwidth, now)) {
+			delete(l.principals, principal)
+		}
+	}
+}
+
+// perPrincipal reports whether any limit applies per principal.
+func (l Limits) perPrincipal() bool {
+	return l.MaxConnectionsPerPrincipal > 0 || l.DialRatePerPrincipal > 0 || l.BandwidthPerPrincipal > 0
+}
+
+func full(l *rate.Limiter, now time.Time) bool {
+	return l.TokensAt(now) >= float64(l.Burst())
+}
+
+// reserve takes a token from every limiter when all of them have one available right away.
+func reserve(now time.Time, limiters ...*rate.Limiter) bool {
+	var reservations []*rate.Reservation
+
+	for _, l := range limiters {
+		r := l.ReserveN(now, 1)
+		if !r.OK() || r.DelayFrom(now) > 0 {
+			r.CancelAt(now)
+			for _, r := range reservations {
+				r.CancelAt(now)
+			}
+			return false
+		}
+		reservations = append(reservations, r)
+	}
+
+	return true
+}
+
+func newDialLimiter(r float64) *rate.Limiter {
+	if r <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(r), int(math.Max(1, math.Ceil(r))))
+}
+
+func newBandwidthLimiter(bytesPerSecond int) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), max(bytesPerSecond, minBandwidthBurst))
+}
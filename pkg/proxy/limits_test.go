@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/jsiebens/cloud-tunnel/pkg/remotedialer"
+	"golang.org/x/time/rate"
+	"testing"
+	"time"
+)
+
+// testLimiter returns a limiter with a clock that only moves when told to.
+func testLimiter(limits Limits) (*limiter, *time.Time) {
+	now := time.Now()
+	l := newLimiter(limits)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func acquire(t *testing.T, l *limiter, principal string) *lease {
+	t.Helper()
+
+	lease, err := l.acquire(principal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lease
+}
+
+func refused(t *testing.T, l *limiter, principal string) {
+	t.Helper()
+
+	if _, err := l.acquire(principal); !errors.Is(err, remotedialer.ErrLimitExceeded) {
+		t.Fatalf("got %v, want %v", err, remotedialer.ErrLimitExceeded)
+	}
+}
+
+func TestLimiterMaxConnections(t *testing.T) {
+	l, _ := testLimiter(Limits{MaxConnections: 2})
+
+	first := acquire(t, l, "")
+	acquire(t, l, "alice@example.com")
+	refused(t, l, "bob@example.com")
+
+	// a lease is only released once
+	first.release()
+	first.release()
+	if n := l.count(); n != 1 {
+		t.Fatalf("got %d open tunnels, want 1", n)
+	}
+
+	acquire(t, l, "")
+	refused(t, l, "")
+}
+
+func TestLimiterMaxConnectionsPerPrincipal(t *testing.T) {
+	l, _ := testLimiter(Limits{MaxConnectionsPerPrincipal: 1})
+
+	alice := acquire(t, l, "alice@example.com")
+	refused(t, l, "alice@example.com")
+	acquire(t, l, "bob@example.com")
+
+	// tunnels without a principal have no per principal limit
+	acquire(t, l, "")
+	acquire(t, l, "")
+
+	alice.release()
+	acquire(t, l, "alice@example.com")
+}
+
+func TestLimiterDialRate(t *testing.T) {
+	l, now := testLimiter(Limits{DialRate: 2})
+
+	lease := acquire(t, l, "")
+	acquire(t, l, "")
+	refused(t, l, "")
+
+	// releasing a tunnel gives back a connection, not a dial
+	lease.release()
+	refused(t, l, "")
+
+	*now = now.Add(500 * time.Millisecond)
+	acquire(t, l, "")
+	refused(t, l, "")
+}
+
+func TestLimiterDialRatePerPrincipal(t *testing.T) {
+	l, now := testLimiter(Limits{DialRate: 10, DialRatePerPrincipal: 1})
+
+	acquire(t, l, "alice@example.com")
+	refused(t, l, "alice@example.com")
+	acquire(t, l, "bob@example.com")
+
+	*now = now.Add(time.Second)
+	acquire(t, l, "alice@example.com")
+}
+
+func TestLimiterRefusalTakesNoDial(t *testing.T) {
+	l, _ := testLimiter(Limits{DialRate: 2, DialRatePerPrincipal: 1})
+
+	acquire(t, l, "alice@example.com")
+	refused(t, l, "alice@example.com")
+
+	// the refused tunnel of alice gave back the dial it took from the global rate
+	acquire(t, l, "bob@example.com")
+	refused(t, l, "carol@example.com")
+}
+
+func TestLimiterBandwidth(t *testing.T) {
+	l, _ := testLimiter(Limits{Bandwidth: 1 << 20, BandwidthPerPrincipal: 1 << 16})
+
+	a1 := acquire(t, l, "alice@example.com")
+	a2 := acquire(t, l, "alice@example.com")
+	b := acquire(t, l, "bob@example.com")
+	anonymous := acquire(t, l, "")
+
+	if len(a1.bandwidth) != 2 || a1.bandwidth[0].Limit() != rate.Limit(1<<20) || a1.bandwidth[1].Limit() != rate.Limit(1<<16) {
+		t.Fatalf("got %v, want a limiter for the tunnel and one for the principal", a1.bandwidth)
+	}
+
+	// the tunnels of a principal share its limiter, every tunnel has its own
+	if a1.bandwidth[1] != a2.bandwidth[1] || a1.bandwidth[1] == b.bandwidth[1] {
+		t.Fatal("principal limiter not shared by the tunnels of the principal only")
+	}
+	if a1.bandwidth[0] == a2.bandwidth[0] {
+		t.Fatal("tunnel limiter shared")
+	}
+
+	if len(anonymous.bandwidth) != 1 {
+		t.Fatalf("got %d limiters for a tunnel without principal, want 1", len(anonymous.bandwidth))
+	}
+
+	// low limits still let a full read buffer through
+	l2, _ := testLimiter(Limits{Bandwidth: 1024})
+	if burst := acquire(t, l2, "").bandwidth[0].Burst(); burst != minBandwidthBurst {
+		t.Fatalf("got burst %d, want %d", burst, minBandwidthBurst)
+	}
+}
+
+func TestLimiterSweepsIdlePrincipals(t *testing.T) {
+	l, now := testLimiter(Limits{DialRatePerPrincipal: 1, BandwidthPerPrincipal: 1 << 16})
+
+	alice := acquire(t, l, "alice@example.com")
+	acquire(t, l, "bob@example.com").release()
+
+	// bob has no tunnel left and its rates are full again by the time of the sweep, alice still has one open
+	*now = now.Add(principalSweepInterval)
+	acquire(t, l, "")
+
+	if _, ok := l.principals["bob@example.com"]; ok {
+		t.Fatal("idle principal not swept")
+	}
+	if _, ok := l.principals["alice@example.com"]; !ok {
+		t.Fatal("principal with an open tunnel swept")
+	}
+
+	// a principal whose rate is still recovering is kept, forgetting it would reset its rate
+	alice.release()
+	*now = now.Add(principalSweepInterval - 500*time.Millisecond)
+	acquire(t, l, "carol@example.com").release()
+	*now = now.Add(500 * time.Millisecond)
+	acquire(t, l, "")
+
+	if _, ok := l.principals["carol@example.com"]; !ok {
+		t.Fatal("principal swept while its rate is recovering")
+	}
+	if _, ok := l.principals["alice@example.com"]; ok {
+		t.Fatal("idle principal not swept")
+	}
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/jsiebens/cloud-tunnel/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/oauth2"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dialResultSuccess       = "success"
+	dialResultError         = "error"
+	dialResultNotAllowed    = "not_allowed"
+	dialResultLimitExceeded = "limit_exceeded"
+)
+
+var (
+	serverTunnels = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "server",
+		Name:      "active_tunnels",
+		Help:      "Tunnels currently open on the server.",
+	})
+
+	serverDials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "server",
+		Name:      "dials_total",
+		Help:      "Tunnel requests handled by the server, by their result.",
+	}, []string{"result"})
+
+	serverDialDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "server",
+		Name:      "dial_duration_seconds",
+		Help:      "Time for the server to dial an upstream.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	serverMuxSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "server",
+		Name:      "mux_sessions",
+		Help:      "Yamux sessions currently open on the server.",
+	})
+
+	serverBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "server",
+		Name:      "bytes_total",
+		Help:      "Bytes sent to and received from upstreams by the server, by the allowed upstream they matched.",
+	}, []string{"upstream", "direction"})
+
+	proxyConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "proxy",
+		Name:      "active_connections",
+		Help:      "Connections to upstreams currently open, through a tunnel or dialed locally.",
+	}, []string{"mode"})
+
+	proxyDials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "proxy",
+		Name:      "dials_total",
+		Help:      "Upstreams dialed, by the upstream rule they matched, the mode and the result.",
+	}, []string{"route", "mode", "result"})
+
+	proxyDialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "proxy",
+		Name:      "dial_duration_seconds",
+		Help:      "Time to dial an upstream, through a tunnel or locally.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "mode"})
+
+	proxyBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "proxy",
+		Name:      "bytes_total",
+		Help:      "Bytes sent to and received from upstreams, by the route they matched or local for those dialed directly.",
+	}, []string{"upstream", "direction"})
+
+	tokenRefreshFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "token_refresh_failures_total",
+		Help:      "Failures to obtain a token to authenticate tunnels.",
+	}, []string{"type"})
+)
+
+func dialResult(err error) string {
+	if err != nil {
+		return dialResultError
+	}
+	return dialResultSuccess
+}
+
+// meteredConn counts the bytes sent to and received from an upstream, and keeps track of it being open.
+// With an access log, the record is written to it when the connection is closed.
+type meteredConn struct {
+	net.Conn
+	sent       prometheus.Counter
+	received   prometheus.Counter
+	active     prometheus.Gauge
+	once       sync.Once
+	up         atomic.Int64
+	down       atomic.Int64
+	record     *accessRecord
+	accessLog  *slog.Logger
+	conns      *registry
+	terminated atomic.Bool
+}
+
+func meter(conn net.Conn, bytes *prometheus.CounterVec, upstream string, active prometheus.Gauge) *meteredConn {
+	active.Inc()
+	return &meteredConn{
+		Conn:     conn,
+		sent:     bytes.WithLabelValues(upstream, "sent"),
+		received: bytes.WithLabelValues(upstream, "received"),
+		active:   active,
+	}
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(float64(n))
+	c.down.Add(int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(float64(n))
+	c.up.Add(int64(n))
+	return n, err
+}
+
+func (c *meteredConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *meteredConn) Close() error {
+	c.once.Do(func() {
+		c.active.Dec()
+		if c.conns != nil {
+			c.conns.remove(c)
+		}
+		if c.record != nil {
+			c.record.log(c.accessLog, c.closeReason(closeReasonClosed), c.up.Load(), c.down.Load())
+		}
+	})
+	return c.Conn.Close()
+}
+
+// closeReason returns the reason the connection is closed for, the given one unless it was terminated.
+func (c *meteredConn) closeReason(reason string) string {
+	if c.terminated.Load() {
+		return closeReasonTerminated
+	}
+	return reason
+}
+
+// meteredTokenSource counts the failures of the token source it wraps, and keeps the expiry of the last token.
+type meteredTokenSource struct {
+	ts  oauth2.TokenSource
+	typ string
+	exp atomic.Int64
+}
+
+func (s *meteredTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.ts.Token()
+	if err != nil {
+		tokenRefreshFailures.WithLabelValues(s.typ).Inc()
+		return token, err
+	}
+	if !token.Expiry.IsZero() {
+		s.exp.Store(token.Expiry.UnixNano())
+	}
+	return token, nil
+}
+
+// expiry returns the expiry of the last token, zero when there was none yet.
+func (s *meteredTokenSource) expiry() time.Time {
+	if n := s.exp.Load(); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
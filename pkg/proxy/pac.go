@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// PACPath is where the proxy serves its proxy auto-config file.
+const PACPath = "/proxy.pac"
+
+// PAC returns a proxy auto-config file sending the upstreams of the rules with a tunnel to the proxy at addr,
+// and everything else direct. Upstreams with a port match the host on any port, the proxy dials those it has
+// no rule for itself.
+func (c ProxyConfig) PAC(addr string) string {
+	proxy := "PROXY " + pacProxyAddr(addr)
+
+	var conditions []string
+	for _, rule := range c.Rules {
+		if len(rule.tunnels()) == 0 {
+			continue
+		}
+
+		upstreams := rule.Upstreams
+		if len(upstreams) == 0 {
+			upstreams = []string{"*"}
+		}
+
+		for _, u := range upstreams {
+			if u == "*" {
+				return fmt.Sprintf("function FindProxyForURL(url, host) {\n  return %s;\n}\n", jsString(proxy))
+			}
+			if c := pacCondition(u); !slices.Contains(conditions, c) {
+				conditions = append(conditions, c)
+			}
+		}
+	}
+
+	b := &strings.Builder{}
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	if len(conditions) > 0 {
+		fmt.Fprintf(b, "  if (%s) {\n", strings.Join(conditions, " ||\n      "))
+		fmt.Fprintf(b, "    return %s;\n", jsString(proxy))
+		b.WriteString("  }\n")
+	}
+	b.WriteString("  return \"DIRECT\";\n}\n")
+	return b.String()
+}
+
+// Tunnelled reports whether any rule has a tunnel, without one the PAC file sends everything direct.
+func (c ProxyConfig) Tunnelled() bool {
+	return slices.ContainsFunc(c.Rules, func(r Rule) bool { return len(r.tunnels()) != 0 })
+}
+
+// pacCondition returns the expression matching the host of an upstream, see proxyUpstream.matches. Ranges only
+// match IP literals like the proxy does, isInNet would resolve host names, blocking the browser on DNS.
+func pacCondition(upstream string) string {
+	if prefix, err := netip.ParsePrefix(upstream); err == nil {
+		prefix = prefix.Masked()
+		if prefix.Addr().Is4() {
+			mask := net.CIDRMask(prefix.Bits(), 32)
+			return fmt.Sprintf("(/^[0-9.]+$/.test(host) && isInNet(host, %s, %s))", jsString(prefix.Addr().String()), jsString(net.IP(mask).String()))
+		}
+		// only some browsers support IPv6 ranges, host names never contain a colon
+		return fmt.Sprintf("(typeof isInNetEx === \"function\" && host.indexOf(\":\") >= 0 && isInNetEx(host, %s))", jsString(prefix.String()))
+	}
+
+	if host, _, err := net.SplitHostPort(upstream); err == nil {
+		upstream = host
+	}
+
+	if strings.HasPrefix(upstream, "*") {
+		return fmt.Sprintf("shExpMatch(host, %s)", jsString(upstream))
+	}
+	return fmt.Sprintf("host == %s", jsString(upstream))
+}
+
+// pacProxyAddr returns an address browsers can reach the proxy on, the loopback address when it listens on all of them.
+func pacProxyAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
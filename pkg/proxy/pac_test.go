@@ -0,0 +1,81 @@
+package proxy
+
+import "testing"
+
+func TestPAC(t *testing.T) {
+	tunnel := Tunnel{ServiceUrl: "https://tunnel.a.run.app"}
+
+	tests := []struct {
+		name  string
+		addr  string
+		rules []Rule
+		pac   string
+	}{
+		{
+			name:  "no tunnel",
+			addr:  "127.0.0.1:8080",
+			rules: []Rule{{Upstreams: []string{"db.internal:5432"}}},
+			pac: `function FindProxyForURL(url, host) {
+  return "DIRECT";
+}
+`,
+		},
+		{
+			name:  "all upstreams",
+			addr:  ":8080",
+			rules: []Rule{{Tunnel: tunnel}},
+			pac: `function FindProxyForURL(url, host) {
+  return "PROXY 127.0.0.1:8080";
+}
+`,
+		},
+		{
+			name: "upstreams",
+			addr: "127.0.0.1:3128",
+			rules: []Rule{
+				{Tunnel: tunnel, Upstreams: []string{"db.internal:5432", "*.corp.internal", "10.0.0.0/8", "10.1.2.3/8"}},
+				{Tunnels: []Tunnel{{Instance: "vm-1"}}, Upstreams: []string{"fd00::/8", "db.internal:6543"}},
+				{Upstreams: []string{"local.internal"}},
+			},
+			pac: `function FindProxyForURL(url, host) {
+  if (host == "db.internal" ||
+      shExpMatch(host, "*.corp.internal") ||
+      (/^[0-9.]+$/.test(host) && isInNet(host, "10.0.0.0", "255.0.0.0")) ||
+      (typeof isInNetEx === "function" && host.indexOf(":") >= 0 && isInNetEx(host, "fd00::/8"))) {
+    return "PROXY 127.0.0.1:3128";
+  }
+  return "DIRECT";
+}
+`,
+		},
+		{
+			name:  "quoted",
+			addr:  "[::]:8080",
+			rules: []Rule{{Tunnel: tunnel, Upstreams: []string{`db".internal`}}},
+			pac: `function FindProxyForURL(url, host) {
+  if (host == "db\".internal") {
+    return "PROXY 127.0.0.1:8080";
+  }
+  return "DIRECT";
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if pac := (ProxyConfig{Rules: tt.rules}).PAC(tt.addr); pac != tt.pac {
+				t.Fatalf("got\n%s\nwant\n%s", pac, tt.pac)
+			}
+		})
+	}
+}
+
+func TestTunnelled(t *testing.T) {
+	if (ProxyConfig{Rules: []Rule{{Upstreams: []string{"*"}}}}).Tunnelled() {
+		t.Fatal("rules without a tunnel reported as tunnelled")
+	}
+	if !(ProxyConfig{Rules: []Rule{{}, {Tunnels: []Tunnel{{Instance: "vm-1"}}}}}).Tunnelled() {
+		t.Fatal("rule with a tunnel not reported as tunnelled")
+	}
+}
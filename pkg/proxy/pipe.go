@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/soheilhy/cmux"
+	"golang.org/x/time/rate"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	closeReasonCompleted   = "completed"
+	closeReasonClosed      = "closed"
+	closeReasonIdle        = "idle_timeout"
+	closeReasonMaxDuration = "max_duration"
+	closeReasonDialError   = "dial_error"
+	closeReasonTerminated  = "terminated"
+)
+
+// Timeouts bounds how long a tunnelled connection is kept open, zero meaning no limit.
+type Timeouts struct {
+	// IdleTimeout closes the connection when no bytes are copied in either direction for this long
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MaxDuration closes the connection once it has been open for this long, active or not
+	MaxDuration time.Duration `yaml:"max_duration"`
+}
+
+// override returns the timeouts with those set in o replacing them.
+func (t Timeouts) override(o Timeouts) Timeouts {
+	if o.IdleTimeout != 0 {
+		t.IdleTimeout = o.IdleTimeout
+	}
+	if o.MaxDuration != 0 {
+		t.MaxDuration = o.MaxDuration
+	}
+	return t
+}
+
+type pipeStats struct {
+	reason   string
+	duration time.Duration
+	// up is the number of bytes copied from the first connection to the second, down the other way around
+	up   int64
+	down int64
+}
+
+func (s pipeStats) attrs() []any {
+	return []any{"reason", s.reason, "duration", s.duration.Round(time.Millisecond), "bytes_up", s.up, "bytes_down", s.down}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies between both connections until both directions are done or a timeout expires. When one side stops writing,
+// the other side is half-closed so it still gets to answer, connections unable to half-close are closed completely.
+// The bytes copied in both directions are shaped by the given bandwidth limiters.
+func pipe(from, to io.ReadWriteCloser, timeouts Timeouts, bandwidth ...*rate.Limiter) pipeStats {
+	start := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var (
+		once       sync.Once
+		reason     string
+		remaining  atomic.Int32
+		lastActive atomic.Int64
+		up, down   atomic.Int64
+	)
+
+	closeWith := func(r string) {
+		once.Do(func() { reason = r })
+		cancel()
+	}
+
+	remaining.Store(2)
+	lastActive.Store(start.UnixNano())
+
+	cp := func(dst, src io.ReadWriteCloser, n *atomic.Int64) {
+		_, err := io.Copy(dst, &activityReader{ctx: ctx, r: src, n: n, lastActive: &lastActive, bandwidth: bandwidth})
+		if err == nil && closeWrite(dst) == nil {
+			if remaining.Add(-1) > 0 {
+				return
+			}
+			closeWith(closeReasonCompleted)
+			return
+		}
+		closeWith(closeReasonClosed)
+	}
+
+	go cp(to, from, &up)
+	go cp(from, to, &down)
+
+	watch(ctx, timeouts, &lastActive, closeWith)
+
+	_ = from.Close()
+	_ = to.Close()
+
+	return pipeStats{reason: reason, duration: time.Since(start), up: up.Load(), down: down.Load()}
+}
+
+// watch blocks until the context is done, closing the pipe when it is idle or open for too long.
+func watch(ctx context.Context, timeouts Timeouts, lastActive *atomic.Int64, closeWith func(string)) {
+	var idle, maxDuration <-chan time.Time
+
+	if timeouts.IdleTimeout > 0 {
+		t := time.NewTimer(timeouts.IdleTimeout)
+		defer t.Stop()
+		idle = t.C
+	}
+
+	if timeouts.MaxDuration > 0 {
+		t := time.NewTimer(timeouts.MaxDuration)
+		defer t.Stop()
+		maxDuration = t.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-maxDuration:
+			closeWith(closeReasonMaxDuration)
+			return
+		case <-idle:
+			since := time.Since(time.Unix(0, lastActive.Load()))
+			if since >= timeouts.IdleTimeout {
+				closeWith(closeReasonIdle)
+				return
+			}
+			idle = time.After(timeouts.IdleTimeout - since)
+		}
+	}
+}
+
+// activityReader counts the bytes read and records when that last happened, holding on to them
+// until the bandwidth limiters let them through.
+type activityReader struct {
+	ctx        context.Context
+	r          io.Reader
+	n          *atomic.Int64
+	lastActive *atomic.Int64
+	bandwidth  []*rate.Limiter
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	for _, l := range a.bandwidth {
+		p = p[:min(len(p), l.Burst())]
+	}
+
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.n.Add(int64(n))
+		a.lastActive.Store(time.Now().UnixNano())
+	}
+
+	for _, l := range a.bandwidth {
+		if werr := l.WaitN(a.ctx, n); werr != nil && err == nil {
+			return 0, werr
+		}
+	}
+
+	return n, err
+}
+
+func closeWrite(c io.ReadWriteCloser) error {
+	if m, ok := c.(*cmux.MuxConn); ok {
+		c = m.Conn
+	}
+
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.ErrUnsupported
+}
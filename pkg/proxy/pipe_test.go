@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testPipe pipes between two in-memory connections, returning the client and upstream ends and the stats once done.
+func testPipe(timeouts Timeouts) (client, upstream net.Conn, stats <-chan pipeStats) {
+	client, from := net.Pipe()
+	to, upstream := net.Pipe()
+
+	ch := make(chan pipeStats, 1)
+	go func() { ch <- pipe(from, to, timeouts) }()
+
+	return client, upstream, ch
+}
+
+func waitPipe(t *testing.T, stats <-chan pipeStats) pipeStats {
+	t.Helper()
+
+	select {
+	case s := <-stats:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipe not done")
+		return pipeStats{}
+	}
+}
+
+func TestPipeCopies(t *testing.T) {
+	client, upstream, stats := testPipe(Timeouts{})
+
+	go func() {
+		buf := make([]byte, 5)
+		_, _ = io.ReadFull(upstream, buf)
+		_, _ = upstream.Write([]byte("pong!!"))
+	}()
+
+	if _, err := client.Write([]byte("ping!")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+
+	s := waitPipe(t, stats)
+	if s.reason != closeReasonClosed || s.up != 5 || s.down != 6 {
+		t.Fatalf("got %s with %d bytes up and %d down, want %s with 5 and 6", s.reason, s.up, s.down, closeReasonClosed)
+	}
+
+	// the other side is closed as well
+	if _, err := upstream.Read(buf); err == nil {
+		t.Fatal("upstream still open")
+	}
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tcpPair := func() (net.Conn, net.Conn) {
+		c1, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c1, c2
+	}
+
+	client, from := tcpPair()
+	to, upstream := tcpPair()
+	defer client.Close()
+	defer upstream.Close()
+
+	stats := make(chan pipeStats, 1)
+	go func() { stats <- pipe(from, to, Timeouts{}) }()
+
+	// the upstream still gets to answer once the client is done writing
+	_, _ = client.Write([]byte("request"))
+	_ = client.(*net.TCPConn).CloseWrite()
+
+	request, err := io.ReadAll(upstream)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("got %q, %v, want the request", request, err)
+	}
+	_, _ = upstream.Write([]byte("response"))
+	_ = upstream.(*net.TCPConn).CloseWrite()
+
+	response, err := io.ReadAll(client)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("got %q, %v, want the response", response, err)
+	}
+
+	if s := waitPipe(t, stats); s.reason != closeReasonCompleted {
+		t.Fatalf("got %s, want %s", s.reason, closeReasonCompleted)
+	}
+}
+
+func TestPipeIdleTimeout(t *testing.T) {
+	client, upstream, stats := testPipe(Timeouts{IdleTimeout: 100 * time.Millisecond})
+	defer client.Close()
+
+	go func() { _, _ = io.Copy(io.Discard, upstream) }()
+
+	// activity pushes the timeout back
+	start := time.Now()
+	for range 4 {
+		if _, err := client.Write([]byte("keepalive")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	s := waitPipe(t, stats)
+	if s.reason != closeReasonIdle {
+		t.Fatalf("got %s, want %s", s.reason, closeReasonIdle)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Fatalf("closed after %v, want the writes to keep it open", d)
+	}
+}
+
+func TestPipeMaxDuration(t *testing.T) {
+	client, upstream, stats := testPipe(Timeouts{IdleTimeout: 100 * time.Millisecond, MaxDuration: 200 * time.Millisecond})
+	defer client.Close()
+
+	go func() { _, _ = io.Copy(io.Discard, upstream) }()
+
+	// a busy connection is closed all the same
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, err := client.Write([]byte("busy")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	s := waitPipe(t, stats)
+	if s.reason != closeReasonMaxDuration {
+		t.Fatalf("got %s, want %s", s.reason, closeReasonMaxDuration)
+	}
+	if s.duration < 200*time.Millisecond {
+		t.Fatalf("closed after %v, want %v", s.duration, 200*time.Millisecond)
+	}
+	<-done
+}
+
+func TestTimeoutsOverride(t *testing.T) {
+	t1 := Timeouts{IdleTimeout: time.Minute, MaxDuration: time.Hour}
+
+	if got := t1.override(Timeouts{IdleTimeout: time.Second}); got != (Timeouts{IdleTimeout: time.Second, MaxDuration: time.Hour}) {
+		t.Fatalf("got %+v", got)
+	}
+	if got := t1.override(Timeouts{}); got != t1 {
+		t.Fatalf("got %+v, want %+v", got, t1)
+	}
+}
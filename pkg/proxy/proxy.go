@@ -3,42 +3,107 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"github.com/jsiebens/cloud-tunnel/pkg/iap"
 	"github.com/jsiebens/cloud-tunnel/pkg/remotedialer"
+	"github.com/jsiebens/cloud-tunnel/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
 	"golang.org/x/sync/errgroup"
 	"log/slog"
 	"net"
 	"net/netip"
 	"net/url"
+	"sort"
 	"strings"
 	"tailscale.com/net/proxymux"
 	"time"
 )
 
+// ServeProxy serves the proxy on the listener until serving fails.
 func ServeProxy(ctx context.Context, ln net.Listener, c ProxyConfig) error {
-	targets, err := c.createProxyUpstreams(ctx)
+	p, err := newProxy(ctx, ln, c)
 	if err != nil {
 		return err
 	}
+	defer p.close()
 
-	p := &httpProxy{
-		targets: targets,
-		dialer:  &net.Dialer{Timeout: c.Timeout},
+	return p.serve()
+}
+
+// proxy is the HTTP and SOCKS5 proxy sharing a listener, set up but not yet serving.
+type proxy struct {
+	ln      net.Listener
+	targets []proxyUpstream
+	http    *httpProxy
+	socks5  *socks5Proxy
+	stop    func()
+}
+
+// newProxy sets up the upstreams, the access log, the admin API and the control socket, so errors in the config or
+// the credentials are returned before anything relies on the proxy.
+func newProxy(ctx context.Context, ln net.Listener, c ProxyConfig) (_ *proxy, err error) {
+	status := newTracker("proxy", ln.Addr().String())
+
+	targets, err := c.createProxyUpstreams(ctx, status)
+	if err != nil {
+		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			proxyUpstreams(targets).close()
+		}
+	}()
 
-	s := &socks5Proxy{
-		targets: targets,
-		dialer:  &net.Dialer{Timeout: c.Timeout},
+	accessLog, err := c.AccessLog.logger()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Admin.start(status.conns, false); err != nil {
+		return nil, err
+	}
+
+	stop, err := status.serveControl(c.ControlSocket)
+	if err != nil {
+		return nil, err
 	}
 
-	socksListener, httpListener := proxymux.SplitSOCKSAndHTTP(ln)
+	return &proxy{
+		ln:      ln,
+		targets: targets,
+		http: &httpProxy{
+			targets:   targets,
+			dialer:    &net.Dialer{Timeout: c.Timeout},
+			accessLog: accessLog,
+			status:    status,
+			pac:       c.PAC,
+		},
+		socks5: &socks5Proxy{
+			targets:   targets,
+			dialer:    &net.Dialer{Timeout: c.Timeout},
+			accessLog: accessLog,
+			status:    status,
+		},
+		stop: stop,
+	}, nil
+}
+
+func (p *proxy) serve() error {
+	socksListener, httpListener := proxymux.SplitSOCKSAndHTTP(p.ln)
 
 	g := new(errgroup.Group)
-	g.Go(func() error { return s.serve(socksListener) })
-	g.Go(func() error { return p.serve(httpListener) })
+	g.Go(func() error { return p.socks5.serve(socksListener) })
+	g.Go(func() error { return p.http.serve(httpListener) })
 
 	return g.Wait()
 }
 
+func (p *proxy) close() {
+	p.stop()
+	proxyUpstreams(p.targets).close()
+}
+
 func StartProxy(ctx context.Context, addr string, c ProxyConfig) error {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -51,69 +116,306 @@ func StartProxy(ctx context.Context, addr string, c ProxyConfig) error {
 }
 
 type ProxyConfig struct {
-	Rules   []Rule        `yaml:"rules"`
-	Timeout time.Duration `yaml:"dial_timeout"`
+	Rules     []Rule        `yaml:"rules"`
+	Timeout   time.Duration `yaml:"dial_timeout"`
+	AccessLog AccessLog     `yaml:"access_log"`
+	// Admin serves the connections of the proxy, a token is optional as it is meant to listen on a local address
+	Admin Admin `yaml:"admin"`
+	// ControlSocket is the unix socket the status of the proxy is served on
+	ControlSocket string `yaml:"control_socket"`
 }
 
 type Rule struct {
-	Tunnel    Tunnel   `yaml:"tunnel"`
-	Upstreams []string `yaml:"upstreams"`
+	Tunnel         Tunnel   `yaml:"tunnel"`
+	Tunnels        []Tunnel `yaml:"tunnels"`
+	TunnelStrategy string   `yaml:"tunnel_strategy"`
+	Upstreams      []string `yaml:"upstreams"`
+}
+
+func (r Rule) tunnels() []Tunnel {
+	var tunnels []Tunnel
+	if r.Tunnel.configured() {
+		tunnels = append(tunnels, r.Tunnel)
+	}
+	for _, t := range r.Tunnels {
+		if t.configured() {
+			tunnels = append(tunnels, t)
+		}
+	}
+	return tunnels
+}
+
+func (r Rule) dialer(ctx context.Context, status *ruleTracker) (remotedialer.Dialer, error) {
+	tunnels := r.tunnels()
+	if len(tunnels) == 1 {
+		return tunnels[0].dialer(ctx, status)
+	}
+
+	strategy, err := parseStrategy(r.TunnelStrategy, remotedialer.Failover, remotedialer.RoundRobin, remotedialer.LeastConnections, remotedialer.LowestLatency)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialers []remotedialer.Dialer
+	for _, t := range tunnels {
+		dialer, err := t.dialer(ctx, status)
+		if err != nil {
+			return nil, err
+		}
+		dialers = append(dialers, dialer)
+	}
+
+	return remotedialer.Balanced(strategy, dialers...), nil
 }
 
 type Tunnel struct {
-	Instance       string `yaml:"instance"`
-	Port           int    `yaml:"port"`
-	Project        string `yaml:"project"`
-	Zone           string `yaml:"zone"`
-	ServiceUrl     string `yaml:"service_url"`
-	ServiceAccount string `yaml:"service_account"`
-	MuxEnabled     bool   `yaml:"mux"`
+	Instance         string           `yaml:"instance"`
+	InstanceSelector InstanceSelector `yaml:"instance_selector"`
+	InstanceStrategy string           `yaml:"instance_strategy"`
+	Port             int              `yaml:"port"`
+	Project          string           `yaml:"project"`
+	Zone             string           `yaml:"zone"`
+	ServiceUrl       string           `yaml:"service_url"`
+	ServiceAccount   string           `yaml:"service_account"`
+	Transport        string           `yaml:"transport"`
+	MuxEnabled       bool             `yaml:"mux"`
+	MuxConfig        MuxConfig        `yaml:"mux_config"`
+	Retry            Retry            `yaml:"retry"`
+	Pool             Pool             `yaml:"pool"`
 }
 
-func (c ProxyConfig) createProxyUpstreams(ctx context.Context) ([]proxyUpstream, error) {
-	var targets []proxyUpstream
+type MuxConfig struct {
+	MaxSessions          int           `yaml:"max_sessions"`
+	MaxStreamsPerSession int           `yaml:"max_streams_per_session"`
+	Placement            string        `yaml:"placement"`
+	WindowSize           uint32        `yaml:"window_size"`
+	KeepAliveInterval    time.Duration `yaml:"keepalive_interval"`
+	AcceptBacklog        int           `yaml:"accept_backlog"`
+	HealthCheckInterval  time.Duration `yaml:"health_check_interval"`
+	HealthCheckTimeout   time.Duration `yaml:"health_check_timeout"`
+	MaxSessionAge        time.Duration `yaml:"max_session_age"`
+}
 
-	for _, rule := range c.Rules {
-		t := rule.Tunnel
-		if t.ServiceUrl != "" {
-			u, err := url.Parse(t.ServiceUrl)
-			if err != nil {
-				return nil, err
-			}
+func (c MuxConfig) options() (remotedialer.MuxOptions, error) {
+	placement := remotedialer.Placement(c.Placement)
+	switch placement {
+	case "":
+		placement = remotedialer.LeastStreams
+	case remotedialer.LeastStreams, remotedialer.LowestRTT:
+	default:
+		return remotedialer.MuxOptions{}, fmt.Errorf("unsupported placement '%s'", c.Placement)
+	}
+
+	opts := remotedialer.MuxOptions{
+		MaxSessions:          c.MaxSessions,
+		MaxStreamsPerSession: c.MaxStreamsPerSession,
+		Placement:            placement,
+		WindowSize:           c.WindowSize,
+		KeepAliveInterval:    c.KeepAliveInterval,
+		AcceptBacklog:        c.AcceptBacklog,
+		HealthCheckInterval:  c.HealthCheckInterval,
+		HealthCheckTimeout:   c.HealthCheckTimeout,
+		MaxSessionAge:        c.MaxSessionAge,
+	}
+
+	if _, err := opts.YamuxConfig(); err != nil {
+		return remotedialer.MuxOptions{}, err
+	}
+	return opts, nil
+}
+
+type Pool struct {
+	Size    int           `yaml:"size"`
+	MaxIdle time.Duration `yaml:"max_idle"`
+}
+
+type Retry struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+type InstanceSelector struct {
+	Labels          map[string]string `yaml:"labels"`
+	NamePrefix      string            `yaml:"name_prefix"`
+	InstanceGroup   string            `yaml:"instance_group"`
+	RefreshInterval time.Duration     `yaml:"refresh_interval"`
+}
+
+func (s InstanceSelector) empty() bool {
+	return len(s.Labels) == 0 && s.NamePrefix == "" && s.InstanceGroup == ""
+}
+
+func (t Tunnel) configured() bool {
+	return t.ServiceUrl != "" || t.Instance != "" || !t.InstanceSelector.empty()
+}
+
+// target describes what the tunnel connects to.
+func (t Tunnel) target() string {
+	switch {
+	case t.ServiceUrl != "":
+		return t.ServiceUrl
+	case t.Instance != "":
+		return "instance " + t.Instance
+	}
+
+	var selectors []string
+	if len(t.InstanceSelector.Labels) > 0 {
+		var labels []string
+		for k, v := range t.InstanceSelector.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		selectors = append(selectors, "labels "+strings.Join(labels, ","))
+	}
+	if t.InstanceSelector.NamePrefix != "" {
+		selectors = append(selectors, "prefix "+t.InstanceSelector.NamePrefix)
+	}
+	if t.InstanceSelector.InstanceGroup != "" {
+		selectors = append(selectors, "group "+t.InstanceSelector.InstanceGroup)
+	}
+	return "instances with " + strings.Join(selectors, ", ")
+}
+
+func (t Tunnel) dialer(ctx context.Context, status *ruleTracker) (remotedialer.Dialer, error) {
+	// cloud run
+	if t.ServiceUrl != "" {
+		u, err := url.Parse(t.ServiceUrl)
+		if err != nil {
+			return nil, err
+		}
+
+		ts, err := idTokenSource(ctx, t.ServiceUrl, t.ServiceAccount)
+		if err != nil {
+			return nil, err
+		}
+
+		opts, err := t.options()
+		if err != nil {
+			return nil, err
+		}
+
+		status.addTunnel(t.target(), opts.Transport, ts)
+		return remotedialer.RemoteDialer(ts, u, opts), nil
+	}
+
+	// iap
+	strategy, err := parseStrategy(t.InstanceStrategy, remotedialer.Failover, remotedialer.RoundRobin)
+	if err != nil {
+		return nil, err
+	}
+
+	ts, err := tokenSource(ctx, t.ServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	instances, err := t.instances(ctx, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := t.options()
+	if err != nil {
+		return nil, err
+	}
+
+	status.addTunnel(t.target(), opts.Transport, ts)
+	return remotedialer.IAPRemoteDialer(ts, instances, t.Port, strategy, opts), nil
+}
 
-			ts, err := idTokenSource(ctx, t.ServiceUrl, t.ServiceAccount)
-			if err != nil {
-				return nil, err
-			}
+func (t Tunnel) options() (remotedialer.Options, error) {
+	mux, err := t.MuxConfig.options()
+	if err != nil {
+		return remotedialer.Options{}, err
+	}
 
-			dialer := remotedialer.RemoteDialer(ts, u, t.MuxEnabled)
+	transport := remotedialer.Transport(t.Transport)
+	switch transport {
+	case "":
+		transport = remotedialer.UpgradeTransport
+	case remotedialer.UpgradeTransport, remotedialer.WebSocketTransport, remotedialer.HTTP2Transport, remotedialer.GRPCTransport:
+	default:
+		return remotedialer.Options{}, fmt.Errorf("unsupported transport '%s'", t.Transport)
+	}
 
-			if len(rule.Upstreams) == 0 {
-				targets = append(targets, newProxyUpstream("*", dialer))
-				continue
-			}
+	return remotedialer.Options{
+		Transport:  transport,
+		Mux:        t.MuxEnabled,
+		MuxOptions: mux,
+		Retry: remotedialer.RetryPolicy{
+			MaxAttempts:    t.Retry.MaxAttempts,
+			InitialBackoff: t.Retry.InitialBackoff,
+			MaxBackoff:     t.Retry.MaxBackoff,
+		},
+		PoolSize:    t.Pool.Size,
+		PoolMaxIdle: t.Pool.MaxIdle,
+	}, nil
+}
 
-			for _, upstream := range rule.Upstreams {
-				targets = append(targets, newProxyUpstream(upstream, dialer))
-			}
+func parseStrategy(s string, supported ...remotedialer.Strategy) (remotedialer.Strategy, error) {
+	if s == "" {
+		return remotedialer.Failover, nil
+	}
+
+	for _, strategy := range supported {
+		if remotedialer.Strategy(s) == strategy {
+			return strategy, nil
 		}
+	}
 
-		if t.Instance != "" {
-			ts, err := tokenSource(ctx, t.ServiceAccount)
-			if err != nil {
-				return nil, err
-			}
+	return "", fmt.Errorf("unsupported strategy '%s'", s)
+}
 
-			dialer := remotedialer.IAPRemoteDialer(ts, t.Instance, t.Port, t.Project, t.Zone, t.MuxEnabled)
+func (t Tunnel) instances(ctx context.Context, ts oauth2.TokenSource) (iap.Instances, error) {
+	project := t.Project
+	if project == "" {
+		var err error
+		if project, err = iap.DefaultProject(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	lookup, err := iap.NewComputeLookup(ctx, ts)
+	if err != nil {
+		return nil, err
+	}
 
-			if len(rule.Upstreams) == 0 {
-				targets = append(targets, newProxyUpstream("*", dialer))
-				continue
-			}
+	s := t.InstanceSelector
+	if s.empty() {
+		return iap.DiscoverInstance(lookup, project, t.Zone, t.Instance), nil
+	}
+
+	selector := iap.Selector{
+		Labels:        s.Labels,
+		NamePrefix:    s.NamePrefix,
+		InstanceGroup: s.InstanceGroup,
+	}
 
-			for _, upstream := range rule.Upstreams {
-				targets = append(targets, newProxyUpstream(upstream, dialer))
-			}
+	return iap.NewResolver(ctx, lookup, project, t.Zone, selector, s.RefreshInterval), nil
+}
+
+func (c ProxyConfig) createProxyUpstreams(ctx context.Context, status *tracker) ([]proxyUpstream, error) {
+	var targets []proxyUpstream
+
+	for _, rule := range c.Rules {
+		if len(rule.tunnels()) == 0 {
+			continue
+		}
+
+		dialer, err := rule.dialer(ctx, status.addRule(rule.Upstreams))
+		if err != nil {
+			proxyUpstreams(targets).close()
+			return nil, err
+		}
+
+		if len(rule.Upstreams) == 0 {
+			targets = append(targets, newProxyUpstream("*", dialer))
+			continue
+		}
+
+		for _, upstream := range rule.Upstreams {
+			targets = append(targets, newProxyUpstream(upstream, dialer))
 		}
 	}
 
@@ -180,12 +482,82 @@ func (u proxyUpstream) matches(candidate string) bool {
 
 type proxyUpstreams []proxyUpstream
 
-func (p proxyUpstreams) getDialer(target string, local remotedialer.Dialer) (string, remotedialer.Dialer) {
+// close stops the dialers of the upstreams, once for every rule as the upstreams of a rule share its dialer.
+func (p proxyUpstreams) close() {
+	closed := make(map[remotedialer.Dialer]bool)
+	for _, u := range p {
+		if !closed[u.dialer] {
+			closed[u.dialer] = true
+			_ = remotedialer.Close(u.dialer)
+		}
+	}
+}
+
+// getDialer returns the upstream rule the target matches, the mode and the dialer to use for the target.
+func (p proxyUpstreams) getDialer(target string, local remotedialer.Dialer) (string, string, remotedialer.Dialer) {
 	for _, u := range p {
 		if u.matches(target) {
-			return "remote", u.dialer
+			return u.upstream, "remote", u.dialer
 		}
 	}
 
-	return "local", local
+	return "", "local", local
+}
+
+func (p proxyUpstreams) dialContext(ctx context.Context, local remotedialer.Dialer, accessLog *slog.Logger, status *tracker, network, addr string) (net.Conn, error) {
+	record := newAccessRecord("")
+	record.target = addr
+	record.source, _ = ctx.Value(sourceContextKey{}).(string)
+
+	ctx, span := tracer.Start(ctx, "proxy.accept", trace.WithAttributes(
+		attribute.String("tunnel.upstream", addr),
+		attribute.String("tunnel.connection_id", record.id),
+	))
+
+	_, matchSpan := tracer.Start(ctx, "proxy.match_rule")
+	route, mode, dialer := p.getDialer(addr, local)
+	slog.Debug("Matched upstream rule", "addr", addr, "rule", route, "mode", mode)
+	matchSpan.SetAttributes(attribute.String("proxy.route", route), attribute.String("proxy.mode", mode))
+	matchSpan.End()
+
+	record.rule, record.mode = route, mode
+
+	info := &remotedialer.DialInfo{ConnectionID: record.id}
+
+	start := time.Now()
+	conn, err := dialer.DialContext(remotedialer.WithDialInfo(ctx, info), network, addr)
+	proxyDials.WithLabelValues(route, mode, dialResult(err)).Inc()
+	proxyDialDuration.WithLabelValues(route, mode).Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
+	status.observe(route, addr, err)
+
+	record.transport, record.principal = string(info.Transport), info.Principal
+
+	if err != nil {
+		logDialError("Error dialing upstream", addr, err)
+		record.log(accessLog, closeReasonDialError, 0, 0)
+		return conn, err
+	}
+
+	slog.Info("Dialed upstream", "addr", addr, "mode", mode, "id", record.id)
+
+	// bytes are counted per route rather than per target to keep the number of series bounded, local dials have no route
+	upstream := route
+	if mode == "local" {
+		upstream = mode
+	}
+	m := meter(conn, proxyBytes, upstream, proxyConnections.WithLabelValues(mode))
+	m.record, m.accessLog = record, accessLog
+	status.conns.add(m)
+	return m, nil
+}
+
+type sourceContextKey struct{}
+
+func logDialError(msg string, addr string, err error) {
+	if hint := remotedialer.Hint(err); hint != "" {
+		slog.Error(msg, "addr", addr, "err", err, "hint", hint)
+		return
+	}
+	slog.Error(msg, "addr", addr, "err", err)
 }
@@ -12,8 +12,11 @@ import (
 )
 
 type httpProxy struct {
-	dialer  remotedialer.Dialer
-	targets proxyUpstreams
+	dialer    remotedialer.Dialer
+	targets   proxyUpstreams
+	accessLog *slog.Logger
+	status    *tracker
+	pac       func(addr string) string
 }
 
 func (hp *httpProxy) serve(ln net.Listener) error {
@@ -21,6 +24,15 @@ func (hp *httpProxy) serve(ln net.Listener) error {
 }
 
 func (hp *httpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req = req.WithContext(context.WithValue(req.Context(), sourceContextKey{}, req.RemoteAddr))
+
+	// requests for the proxy itself rather than proxied ones have no host in their url
+	if req.Method == http.MethodGet && !req.URL.IsAbs() && req.URL.Path == PACPath {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		_, _ = w.Write([]byte(hp.pac(req.Host)))
+		return
+	}
+
 	if req.Method == http.MethodGet {
 		hp.proxyGet(w, req)
 		return
@@ -43,8 +55,10 @@ func (hp *httpProxy) proxyGet(w http.ResponseWriter, req *http.Request) {
 	}
 
 	p := httputil.NewSingleHostReverseProxy(target)
+	// the transport is not reused, so neither are its connections
 	p.Transport = &http.Transport{
-		DialContext: hp.dialContext,
+		DialContext:       hp.dialContext,
+		DisableKeepAlives: true,
 	}
 
 	p.ServeHTTP(w, req)
@@ -74,18 +88,9 @@ func (hp *httpProxy) proxyConnect(w http.ResponseWriter, req *http.Request) {
 	defer reqConn.Close()
 	defer wbuf.Flush()
 
-	pipe(conn, reqConn)
+	pipe(conn, reqConn, Timeouts{})
 }
 
 func (hp *httpProxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	mode, dialer := hp.targets.getDialer(addr, hp.dialer)
-	conn, err := dialer.DialContext(ctx, network, addr)
-
-	if err != nil {
-		slog.Error("Error dialing upstream", "addr", addr, "err", err)
-		return conn, err
-	}
-
-	slog.Info("Dialed upstream", "addr", addr, "mode", mode)
-	return conn, err
+	return hp.targets.dialContext(ctx, hp.dialer, hp.accessLog, hp.status, network, addr)
 }
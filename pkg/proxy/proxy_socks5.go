@@ -9,8 +9,10 @@ import (
 )
 
 type socks5Proxy struct {
-	dialer  remotedialer.Dialer
-	targets proxyUpstreams
+	dialer    remotedialer.Dialer
+	targets   proxyUpstreams
+	accessLog *slog.Logger
+	status    *tracker
 }
 
 func (sp *socks5Proxy) serve(ln net.Listener) error {
@@ -21,14 +23,5 @@ func (sp *socks5Proxy) serve(ln net.Listener) error {
 }
 
 func (sp *socks5Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	mode, dialer := sp.targets.getDialer(addr, sp.dialer)
-	conn, err := dialer.DialContext(ctx, network, addr)
-
-	if err != nil {
-		slog.Error("Error dialing upstream", "addr", addr, "err", err)
-		return conn, err
-	}
-
-	slog.Info("Dialed upstream", "addr", addr, "mode", mode)
-	return conn, err
+	return sp.targets.dialContext(ctx, sp.dialer, sp.accessLog, sp.status, network, addr)
 }
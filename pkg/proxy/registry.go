@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// registry keeps track of the open connections, for them to be listed and terminated through the admin API.
+type registry struct {
+	sync.Mutex
+	conns map[*meteredConn]struct{}
+}
+
+func newRegistry() *registry {
+	return &registry{conns: make(map[*meteredConn]struct{})}
+}
+
+// Connection describes an open connection, bytes up are those sent to the upstream, bytes down those received from it.
+type Connection struct {
+	ID        string    `json:"id"`
+	ClientID  string    `json:"client_id,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Target    string    `json:"target"`
+	Rule      string    `json:"rule,omitempty"`
+	Mode      string    `json:"mode"`
+	Transport string    `json:"transport,omitempty"`
+	Started   time.Time `json:"started"`
+	Age       string    `json:"age"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+func (r *registry) add(c *meteredConn) {
+	r.Lock()
+	defer r.Unlock()
+	r.conns[c] = struct{}{}
+	c.conns = r
+}
+
+func (r *registry) remove(c *meteredConn) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.conns, c)
+}
+
+// list returns the open connections, oldest first, only those of the principal when it is not empty.
+func (r *registry) list(principal string) []Connection {
+	infos := []Connection{}
+	for _, c := range r.find(func(c *meteredConn) bool { return principal == "" || c.record.principal == principal }) {
+		infos = append(infos, Connection{
+			ID:        c.record.id,
+			ClientID:  c.record.clientID,
+			Principal: c.record.principal,
+			Source:    c.record.source,
+			Target:    c.record.target,
+			Rule:      c.record.rule,
+			Mode:      c.record.mode,
+			Transport: c.record.transport,
+			Started:   c.record.start,
+			Age:       time.Since(c.record.start).Round(time.Second).String(),
+			BytesUp:   c.up.Load(),
+			BytesDown: c.down.Load(),
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+	return infos
+}
+
+// terminate closes the connections with the given id, returning how many there were.
+func (r *registry) terminate(id string) int {
+	return r.terminateAll(r.find(func(c *meteredConn) bool { return c.record.id == id }))
+}
+
+// terminatePrincipal closes all connections of the principal, returning how many there were.
+func (r *registry) terminatePrincipal(principal string) int {
+	return r.terminateAll(r.find(func(c *meteredConn) bool { return c.record.principal == principal }))
+}
+
+func (r *registry) terminateAll(conns []*meteredConn) int {
+	for _, c := range conns {
+		c.terminated.Store(true)
+		_ = c.Close()
+	}
+	return len(conns)
+}
+
+func (r *registry) find(match func(*meteredConn) bool) []*meteredConn {
+	r.Lock()
+	defer r.Unlock()
+
+	var conns []*meteredConn
+	for c := range r.conns {
+		if match(c) {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
@@ -6,30 +6,91 @@ import (
 	"fmt"
 	"github.com/hashicorp/yamux"
 	"github.com/jsiebens/cloud-tunnel/pkg/remotedialer"
+	"github.com/jsiebens/cloud-tunnel/pkg/tracing"
 	"github.com/soheilhy/cmux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
 const DefaultTimeout = 5 * time.Second
 
-func StartServer(addr string, timeout time.Duration, allowedUpstreams []string) error {
-	server := newTunnelServer(timeout, allowedUpstreams)
+// DefaultDrainTimeout stays below the 10 seconds Cloud Run gives an instance between SIGTERM and SIGKILL.
+const DefaultDrainTimeout = 8 * time.Second
+
+var tracer = otel.Tracer("github.com/jsiebens/cloud-tunnel/pkg/proxy")
+
+type ServerConfig struct {
+	Timeout          time.Duration `yaml:"dial_timeout"`
+	AllowedUpstreams []string      `yaml:"allowed_upstreams"`
+	// Mux configures the yamux sessions of clients connecting in mux mode, only the window size,
+	// keepalive interval and accept backlog apply to the server
+	Mux      MuxConfig `yaml:"mux"`
+	Timeouts Timeouts  `yaml:"timeouts"`
+	// Principals overrides the timeouts for tunnels opened with the ID token of the given email
+	Principals map[string]Timeouts `yaml:"principals"`
+	Limits     Limits              `yaml:"limits"`
+	AccessLog  AccessLog           `yaml:"access_log"`
+	// ReadinessProbe is an address dialed on every readiness check, the server is not ready when that fails
+	ReadinessProbe string `yaml:"readiness_probe"`
+	// DrainTimeout is how long open tunnels are given to close once the context is done
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	// DeferredTimeout is how long a deferred connection may wait for its upstream, as it holds a connection slot meanwhile
+	DeferredTimeout time.Duration `yaml:"deferred_timeout"`
+	Admin           Admin         `yaml:"admin"`
+}
+
+// StartServer serves tunnels until the context is done, after which the server is drained.
+func StartServer(ctx context.Context, addr string, c ServerConfig) error {
+	server, err := newTunnelServer(c)
+	if err != nil {
+		return err
+	}
+
+	// the server doesn't verify ID tokens itself, Cloud Run does before a request reaches it
+	if (c.Limits.perPrincipal() || len(c.Principals) > 0) && os.Getenv("K_SERVICE") == "" {
+		slog.Warn("Per principal limits and timeouts use unverified ID tokens, any client may claim a principal unless a proxy in front of the server verifies them")
+	}
+
+	if err := c.Admin.start(server.conns, true); err != nil {
+		return err
+	}
 
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
+	errs := make(chan error, 1)
+	go func() { errs <- server.serve(addr, listener) }()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	server.drain(listener, c.DrainTimeout)
+	return nil
+}
+
+func (s *tunnelServer) serve(addr string, listener net.Listener) error {
 	// if running on Cloud Run, no need to run in muxed mode
 	// see: https://cloud.google.com/run/docs/container-contract#env-vars
 	if os.Getenv("K_SERVICE") != "" {
 		slog.Info(fmt.Sprintf("Listening on %s in standard mode", addr))
-		return server.serveHttp(listener)
+		return s.serveHttp(listener)
 	}
 
 	slog.Info(fmt.Sprintf("Listening on %s in mux mode", addr))
@@ -38,47 +99,133 @@ func StartServer(addr string, timeout time.Duration, allowedUpstreams []string)
 	httpL := m.Match(cmux.HTTP1Fast(), cmux.HTTP2())
 	muxL := m.Match(cmux.Any())
 
-	go server.serveHttp(httpL)
-	go server.serveMux(muxL)
+	go s.serveHttp(httpL)
+	go s.serveMux(muxL)
 
 	return m.Serve()
 }
 
-func newTunnelServer(timeout time.Duration, allowedUpstreams []string) *tunnelServer {
-	dialer := &net.Dialer{Timeout: timeout}
+func newTunnelServer(c ServerConfig) (*tunnelServer, error) {
+	accessLog, err := c.AccessLog.logger()
+	if err != nil {
+		return nil, err
+	}
 
-	if len(allowedUpstreams) == 0 {
-		return &tunnelServer{allowedUpstreams: []proxyUpstream{newProxyUpstream("*", dialer)}}
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	probeTimeout := c.Timeout
+	if probeTimeout == 0 {
+		probeTimeout = DefaultTimeout
 	}
+	deferredTimeout := c.DeferredTimeout
+	if deferredTimeout == 0 {
+		deferredTimeout = remotedialer.DefaultDeferredTimeout
+	}
+	muxConfig, err := remotedialer.MuxOptions{
+		WindowSize:        c.Mux.WindowSize,
+		KeepAliveInterval: c.Mux.KeepAliveInterval,
+		AcceptBacklog:     c.Mux.AcceptBacklog,
+	}.YamuxConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &tunnelServer{
+		muxConfig:            muxConfig,
+		timeouts:             c.Timeouts,
+		principals:           c.Principals,
+		limiter:              newLimiter(c.Limits),
+		maxStreamsPerSession: c.Limits.MaxStreamsPerSession,
+		accessLog:            accessLog,
+		readinessProbe:       c.ReadinessProbe,
+		probeDialer:          &net.Dialer{Timeout: probeTimeout},
+		conns:                newRegistry(),
+		deferredTimeout:      deferredTimeout,
+	}
+	s.grpc = remotedialer.NewGRPCServer(s.handleGRPC)
 
-	var upstreams []proxyUpstream
-	for _, u := range allowedUpstreams {
-		upstreams = append(upstreams, newProxyUpstream(u, dialer))
+	if len(c.AllowedUpstreams) == 0 {
+		s.allowedUpstreams = []proxyUpstream{newProxyUpstream("*", dialer)}
+		return s, nil
 	}
 
-	return &tunnelServer{allowedUpstreams: upstreams}
+	for _, u := range c.AllowedUpstreams {
+		s.allowedUpstreams = append(s.allowedUpstreams, newProxyUpstream(u, dialer))
+	}
+
+	return s, nil
 }
 
 type tunnelServer struct {
-	allowedUpstreams []proxyUpstream
+	allowedUpstreams     []proxyUpstream
+	muxConfig            *yamux.Config
+	grpc                 *grpc.Server
+	timeouts             Timeouts
+	principals           map[string]Timeouts
+	limiter              *limiter
+	maxStreamsPerSession int
+	accessLog            *slog.Logger
+	readinessProbe       string
+	probeDialer          *net.Dialer
+	draining             atomic.Bool
+	conns                *registry
+	deferredTimeout      time.Duration
 }
 
+type connContextKey struct{}
+
 func (s *tunnelServer) serveHttp(ln net.Listener) error {
-	return http.Serve(ln, http.HandlerFunc(s.upgrade))
+	server := &http.Server{
+		Handler: h2c.NewHandler(http.HandlerFunc(s.serveRequest), &http2.Server{}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+	return server.Serve(ln)
+}
+
+func (s *tunnelServer) serveRequest(w http.ResponseWriter, req *http.Request) {
+	// the stream carrying the request counts as well
+	if stream, ok := req.Context().Value(connContextKey{}).(sessionStream); ok && s.maxStreamsPerSession > 0 {
+		if stream.Session().NumStreams() > s.maxStreamsPerSession {
+			slog.Warn("Too many streams in mux session", "remote_addr", stream.RemoteAddr())
+			http.Error(w, "too many streams", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if remotedialer.IsGRPCRequest(req) {
+		s.grpc.ServeHTTP(w, req)
+		return
+	}
+
+	if s.serveHealth(w, req) {
+		return
+	}
+
+	// clients retry elsewhere, also when reusing a connection or mux session opened before draining
+	if s.draining.Load() {
+		http.Error(w, errDraining.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	s.upgrade(w, req)
 }
 
 func (s *tunnelServer) serveMux(ln net.Listener) error {
 	hc := func(conn net.Conn) {
 		defer conn.Close()
 
-		server, err := yamux.Server(conn, nil)
+		server, err := yamux.Server(conn, s.muxConfig)
 		if err != nil {
+			slog.Error("Unable to start mux session", "remote_addr", conn.RemoteAddr(), "err", err)
 			return
 		}
 		defer server.Close()
 
-		tunnel := tunnelServer{allowedUpstreams: s.allowedUpstreams}
-		_ = tunnel.serveHttp(server)
+		serverMuxSessions.Inc()
+		defer serverMuxSessions.Dec()
+
+		_ = s.serveHttp(sessionListener{server})
 	}
 
 	for {
@@ -91,30 +238,128 @@ func (s *tunnelServer) serveMux(ln net.Listener) error {
 	}
 }
 
+// sessionListener accepts streams able to half-close, closing a yamux stream only closes its write side.
+type sessionListener struct {
+	*yamux.Session
+}
+
+func (l sessionListener) Accept() (net.Conn, error) {
+	stream, err := l.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return sessionStream{stream}, nil
+}
+
+type sessionStream struct {
+	*yamux.Stream
+}
+
+func (s sessionStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
 func (s *tunnelServer) upgrade(w http.ResponseWriter, req *http.Request) {
+	principal := remotedialer.Principal(req.Header.Get(remotedialer.AuthorizationHeaderName))
+
 	target := req.Header.Get(remotedialer.UpstreamHeaderName)
-	if len(target) == 0 {
-		http.Error(w, "missing target header", http.StatusBadRequest)
+	deferred := len(target) == 0 && req.Header.Get(remotedialer.DeferredHeaderName) != ""
+
+	record := newAccessRecord(req.Header.Get(remotedialer.ConnectionIDHeaderName))
+	record.principal = principal
+	record.source = req.RemoteAddr
+	record.target = target
+	record.mode = "direct"
+	record.transport = string(requestTransport(req))
+	if _, ok := req.Context().Value(connContextKey{}).(sessionStream); ok {
+		record.mode = "mux"
+	}
+
+	var dialer remotedialer.Dialer
+	if !deferred {
+		if len(target) == 0 {
+			http.Error(w, "missing target header", http.StatusBadRequest)
+			return
+		}
+
+		if record.rule, dialer = s.getDialer(target); dialer == nil {
+			serverDials.WithLabelValues(dialResultNotAllowed).Inc()
+			record.log(s.accessLog, dialResultNotAllowed, 0, 0)
+			http.Error(w, "upstream not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	lease, err := s.limiter.acquire(principal)
+	if err != nil {
+		serverDials.WithLabelValues(dialResultLimitExceeded).Inc()
+		record.log(s.accessLog, dialResultLimitExceeded, 0, 0)
+		slog.Warn("Tunnel limit exceeded", "addr", target, "principal", principal)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
 		return
 	}
+	defer lease.release()
 
-	dialer := s.getDialer(target)
+	conn, ok := s.acceptConnection(w, req)
+	if !ok {
+		return
+	}
 
-	if dialer == nil {
-		http.Error(w, "upstream not allowed", http.StatusForbidden)
+	// the trace of the client continues on this side of the tunnel, which outlives the request
+	ctx := otel.GetTextMapPropagator().Extract(context.WithoutCancel(req.Context()), propagation.HeaderCarrier(req.Header))
+
+	if deferred {
+		s.handleDeferredConnection(ctx, conn, lease, record)
 		return
 	}
 
+	s.handleConnection(ctx, conn, dialer, lease, record)
+}
+
+// requestTransport returns the transport the client uses for the tunnel request.
+func requestTransport(req *http.Request) remotedialer.Transport {
+	switch {
+	case remotedialer.IsGRPCRequest(req):
+		return remotedialer.GRPCTransport
+	case remotedialer.IsHTTP2Request(req):
+		return remotedialer.HTTP2Transport
+	case remotedialer.IsWebSocketRequest(req):
+		return remotedialer.WebSocketTransport
+	}
+	return remotedialer.UpgradeTransport
+}
+
+// acceptConnection completes the upgrade, as an HTTP/2 stream for CONNECT requests, as a proper WebSocket when the
+// client performed a WebSocket handshake and as a plain upgrade for clients only sending the upgrade headers.
+func (s *tunnelServer) acceptConnection(w http.ResponseWriter, req *http.Request) (io.ReadWriteCloser, bool) {
+	if remotedialer.IsHTTP2Request(req) {
+		conn, err := remotedialer.AcceptHTTP2(w, req)
+		if err != nil {
+			slog.Error("Unable to accept http2 stream", "err", err)
+			return nil, false
+		}
+		return conn, true
+	}
+
+	if remotedialer.IsWebSocketRequest(req) {
+		conn, err := remotedialer.AcceptWebSocket(w, req)
+		if err != nil {
+			slog.Error("Unable to accept websocket", "err", err)
+			return nil, false
+		}
+		return conn, true
+	}
+
 	conn, err := s.hijackConnection(w, req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return nil, false
 	}
 
-	s.handleConnection(conn, target, dialer)
+	return conn, true
 }
 
-func (s *tunnelServer) hijackConnection(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+func (s *tunnelServer) hijackConnection(w http.ResponseWriter, r *http.Request) (io.ReadWriteCloser, error) {
 	next := r.Header.Get("Upgrade")
 	if next == "" {
 		return nil, errors.New("missing next protocol")
@@ -128,8 +373,13 @@ func (s *tunnelServer) hijackConnection(w http.ResponseWriter, r *http.Request)
 		return nil, errors.New("make request over HTTP/1")
 	}
 
+	framed := remotedialer.IsFramedRequest(r)
+
 	w.Header().Set("Upgrade", "websocket")
 	w.Header().Set("Connection", "upgrade")
+	if framed {
+		w.Header().Set(remotedialer.FramedHeaderName, "true")
+	}
 	w.WriteHeader(http.StatusSwitchingProtocols)
 
 	conn, brw, err := hijacker.Hijack()
@@ -142,43 +392,178 @@ func (s *tunnelServer) hijackConnection(w http.ResponseWriter, r *http.Request)
 		return nil, fmt.Errorf("flushing hijacked HTTP buffer: %w", err)
 	}
 
+	// clients framing the tunnel are able to half-close it whatever carries it
+	if framed {
+		return remotedialer.Framed(conn), nil
+	}
+
 	return conn, nil
 }
 
-func (s *tunnelServer) handleConnection(conn net.Conn, target string, dialer remotedialer.Dialer) {
+func (s *tunnelServer) handleConnection(ctx context.Context, conn io.ReadWriteCloser, dialer remotedialer.Dialer, lease *lease, record *accessRecord) {
 	defer conn.Close()
-	dst, err := dialer.DialContext(context.Background(), "tcp", target)
+	dst, err := s.dial(ctx, dialer, record)
 	if err != nil {
-		slog.Error("Unable to dial upstream", "addr", target, "err", err)
 		return
 	}
-	slog.Info("Dialed upstream", "addr", target)
 	defer dst.Close()
-	pipe(conn, dst)
+	s.pipe(conn, dst, lease, record)
 }
 
-func (s *tunnelServer) getDialer(target string) remotedialer.Dialer {
-	for _, u := range s.allowedUpstreams {
-		if u.matches(target) {
-			return u.dialer
-		}
+func (s *tunnelServer) handleDeferredConnection(ctx context.Context, conn io.ReadWriteCloser, lease *lease, record *accessRecord) {
+	defer conn.Close()
+
+	// not all transports support deadlines, an idle connection is closed instead
+	timer := time.AfterFunc(s.deferredTimeout, func() { _ = conn.Close() })
+	target, err := remotedialer.ReadTarget(conn)
+	if !timer.Stop() {
+		slog.Debug("Deferred connection received no upstream in time", "timeout", s.deferredTimeout)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	record.target = target
+
+	rule, dialer := s.getDialer(target)
+	if dialer == nil {
+		serverDials.WithLabelValues(dialResultNotAllowed).Inc()
+		record.log(s.accessLog, dialResultNotAllowed, 0, 0)
+		slog.Warn("Upstream not allowed", "addr", target)
+		_ = remotedialer.WriteResult(conn, false, nil)
+		return
+	}
+
+	record.rule = rule
+
+	dst, err := s.dial(ctx, dialer, record)
+	if err != nil {
+		_ = remotedialer.WriteResult(conn, true, err)
+		return
+	}
+	defer dst.Close()
+
+	if err := remotedialer.WriteResult(conn, true, nil); err != nil {
+		return
 	}
 
+	s.pipe(conn, dst, lease, record)
+}
+
+func (s *tunnelServer) handleGRPC(target string, stream *remotedialer.GRPCStream) error {
+	if s.draining.Load() {
+		return remotedialer.ErrDraining
+	}
+
+	principal := remotedialer.Principal(stream.Header(remotedialer.AuthorizationHeaderName))
+
+	record := newAccessRecord(stream.Header(remotedialer.ConnectionIDHeaderName))
+	record.principal = principal
+	record.target = target
+	record.mode = "direct"
+	record.transport = string(remotedialer.GRPCTransport)
+	if addr := stream.RemoteAddr(); addr != nil {
+		record.source = addr.String()
+	}
+
+	rule, dialer := s.getDialer(target)
+	if dialer == nil {
+		serverDials.WithLabelValues(dialResultNotAllowed).Inc()
+		record.log(s.accessLog, dialResultNotAllowed, 0, 0)
+		slog.Warn("Upstream not allowed", "addr", target)
+		return remotedialer.ErrUpstreamNotAllowed
+	}
+
+	record.rule = rule
+
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), grpcCarrier{stream})
+
+	lease, err := s.limiter.acquire(principal)
+	if err != nil {
+		serverDials.WithLabelValues(dialResultLimitExceeded).Inc()
+		record.log(s.accessLog, dialResultLimitExceeded, 0, 0)
+		slog.Warn("Tunnel limit exceeded", "addr", target, "principal", principal)
+		return remotedialer.ErrLimitExceeded
+	}
+	defer lease.release()
+
+	dst, err := s.dial(ctx, dialer, record)
+	if err != nil {
+		return &remotedialer.UpstreamError{Message: err.Error()}
+	}
+	defer dst.Close()
+
+	if err := stream.Accept(); err != nil {
+		return err
+	}
+
+	s.pipe(stream, dst, lease, record)
 	return nil
 }
 
-func pipe(from, to io.ReadWriteCloser) {
-	cp := func(dst io.Writer, src io.Reader, cancel context.CancelFunc) {
-		_, _ = io.Copy(dst, src)
-		cancel()
+func (s *tunnelServer) pipe(conn io.ReadWriteCloser, dst *meteredConn, lease *lease, record *accessRecord) {
+	timeouts := s.timeouts
+	if o, ok := s.principals[lease.principal]; ok && lease.principal != "" {
+		timeouts = timeouts.override(o)
+	}
+
+	stats := pipe(conn, dst, timeouts, lease.bandwidth...)
+	stats.reason = dst.closeReason(stats.reason)
+	record.log(s.accessLog, stats.reason, stats.up, stats.down)
+
+	attrs := append([]any{"addr", record.target}, stats.attrs()...)
+	if lease.principal != "" {
+		attrs = append(attrs, "principal", lease.principal)
+	}
+	slog.Info("Closed upstream", attrs...)
+}
+
+func (s *tunnelServer) dial(ctx context.Context, dialer remotedialer.Dialer, record *accessRecord) (*meteredConn, error) {
+	ctx, span := tracer.Start(ctx, "server.dial", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("tunnel.upstream", record.target),
+		attribute.String("tunnel.principal", record.principal),
+		attribute.String("tunnel.connection_id", record.id),
+	))
+
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", record.target)
+	serverDials.WithLabelValues(dialResult(err)).Inc()
+	serverDialDuration.Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
+	if err != nil {
+		slog.Error("Unable to dial upstream", "addr", record.target, "err", err)
+		record.log(s.accessLog, closeReasonDialError, 0, 0)
+		return nil, err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	slog.Info("Dialed upstream", "addr", record.target, "id", record.id)
+	// the record is written to the access log once the pipe is done, not when the connection is closed,
+	// bytes are counted per allowed upstream rather than per target to keep the number of series bounded
+	m := meter(conn, serverBytes, record.rule, serverTunnels)
+	m.record = record
+	s.conns.add(m)
+	return m, nil
+}
+
+// grpcCarrier reads the trace context from the metadata of a tunnel stream.
+type grpcCarrier struct {
+	stream *remotedialer.GRPCStream
+}
+
+func (c grpcCarrier) Get(key string) string { return c.stream.Header(key) }
+func (c grpcCarrier) Set(string, string)    {}
+func (c grpcCarrier) Keys() []string        { return nil }
 
-	go cp(from, to, cancel)
-	go cp(to, from, cancel)
+// getDialer returns the allowed upstream the target matches and its dialer, or no dialer when the target is not allowed.
+func (s *tunnelServer) getDialer(target string) (string, remotedialer.Dialer) {
+	for _, u := range s.allowedUpstreams {
+		if u.matches(target) {
+			slog.Debug("Matched allowed upstream", "addr", target, "rule", u.upstream)
+			return u.upstream, u.dialer
+		}
+	}
 
-	<-ctx.Done()
-	_ = from.Close()
-	_ = to.Close()
+	slog.Debug("No allowed upstream matched", "addr", target)
+	return "", nil
 }
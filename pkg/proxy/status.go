@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/jsiebens/cloud-tunnel/internal/version"
+	"github.com/jsiebens/cloud-tunnel/pkg/remotedialer"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const maxRecentErrors = 10
+
+const (
+	healthUnknown = "unknown"
+	healthy       = "healthy"
+	healthFailing = "failing"
+)
+
+// Status is what a client process reports about itself on its control socket.
+type Status struct {
+	Command     string       `json:"command"`
+	PID         int          `json:"pid"`
+	ListenAddr  string       `json:"listen_addr"`
+	Version     string       `json:"version"`
+	Started     time.Time    `json:"started"`
+	Rules       []RuleStatus `json:"rules"`
+	Connections []Connection `json:"connections"`
+	Errors      []ErrorEvent `json:"errors"`
+}
+
+// RuleStatus describes an upstream rule, its health being the outcome of the last dial through it.
+type RuleStatus struct {
+	Upstreams []string       `json:"upstreams"`
+	Tunnels   []TunnelStatus `json:"tunnels"`
+	Health    string         `json:"health"`
+	Dials     int64          `json:"dials"`
+	Failures  int64          `json:"failures"`
+	LastError string         `json:"last_error,omitempty"`
+}
+
+type TunnelStatus struct {
+	Target    string `json:"target"`
+	Transport string `json:"transport"`
+	// TokenExpiry is the expiry of the last token used for the tunnel, zero when it was not used yet
+	TokenExpiry *time.Time `json:"token_expiry,omitempty"`
+}
+
+type ErrorEvent struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// tracker keeps track of the status of a client process.
+type tracker struct {
+	sync.Mutex
+	command string
+	addr    string
+	started time.Time
+	conns   *registry
+	rules   []*ruleTracker
+	routes  map[string]*ruleTracker
+	errors  []ErrorEvent
+}
+
+type ruleTracker struct {
+	upstreams []string
+	tunnels   []tunnelTracker
+	dials     int64
+	failures  int64
+	lastErr   error
+}
+
+type tunnelTracker struct {
+	target    string
+	transport string
+	ts        *meteredTokenSource
+}
+
+func newTracker(command, addr string) *tracker {
+	return &tracker{
+		command: command,
+		addr:    addr,
+		started: time.Now(),
+		conns:   newRegistry(),
+		routes:  make(map[string]*ruleTracker),
+	}
+}
+
+// addRule tracks a rule for the given upstreams, all upstreams when there are none.
+func (t *tracker) addRule(upstreams []string) *ruleTracker {
+	t.Lock()
+	defer t.Unlock()
+
+	if len(upstreams) == 0 {
+		upstreams = []string{"*"}
+	}
+
+	r := &ruleTracker{upstreams: upstreams}
+	for _, u := range upstreams {
+		if _, ok := t.routes[u]; !ok {
+			t.routes[u] = r
+		}
+	}
+	t.rules = append(t.rules, r)
+	return r
+}
+
+func (r *ruleTracker) addTunnel(target string, transport remotedialer.Transport, ts *meteredTokenSource) {
+	r.tunnels = append(r.tunnels, tunnelTracker{target: target, transport: string(transport), ts: ts})
+}
+
+// observe records the outcome of a dial of addr through the route, a local dial when the route is empty.
+func (t *tracker) observe(route, addr string, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if r, ok := t.routes[route]; ok && route != "" {
+		r.dials++
+		r.lastErr = err
+		if err != nil {
+			r.failures++
+		}
+	}
+
+	if err != nil {
+		t.errors = append(t.errors, ErrorEvent{Time: time.Now(), Message: fmt.Sprintf("dial %s: %v", addr, err)})
+		if len(t.errors) > maxRecentErrors {
+			t.errors = t.errors[len(t.errors)-maxRecentErrors:]
+		}
+	}
+}
+
+func (t *tracker) status() Status {
+	t.Lock()
+	defer t.Unlock()
+
+	v, _ := version.GetReleaseInfo()
+
+	s := Status{
+		Command:     t.command,
+		PID:         os.Getpid(),
+		ListenAddr:  t.addr,
+		Version:     v,
+		Started:     t.started,
+		Rules:       []RuleStatus{},
+		Connections: t.conns.list(""),
+		Errors:      append([]ErrorEvent{}, t.errors...),
+	}
+
+	for _, r := range t.rules {
+		rs := RuleStatus{Upstreams: r.upstreams, Health: healthUnknown, Dials: r.dials, Failures: r.failures}
+		if r.dials > 0 {
+			rs.Health = healthy
+		}
+		if r.lastErr != nil {
+			rs.Health, rs.LastError = healthFailing, r.lastErr.Error()
+		}
+		for _, tt := range r.tunnels {
+			ts := TunnelStatus{Target: tt.target, Transport: tt.transport}
+			if expiry := tt.ts.expiry(); !expiry.IsZero() {
+				ts.TokenExpiry = &expiry
+			}
+			rs.Tunnels = append(rs.Tunnels, ts)
+		}
+		s.Rules = append(s.Rules, rs)
+	}
+
+	return s
+}
+
+// WriteText writes the status in a human readable form.
+func (s Status) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "%s (pid %d) listening on %s, version %s, up %s\n", s.Command, s.PID, s.ListenAddr, s.Version, since(s.Started))
+
+	fmt.Fprintln(tw, "\nRULES")
+	fmt.Fprintln(tw, "UPSTREAMS\tTUNNEL\tTRANSPORT\tTOKEN EXPIRES\tHEALTH\tDIALS\tFAILURES")
+	for _, r := range s.Rules {
+		for i, t := range r.Tunnels {
+			upstreams, health, dials, failures := "", "", "", ""
+			if i == 0 {
+				upstreams, health = strings.Join(r.Upstreams, ","), r.Health
+				dials, failures = fmt.Sprint(r.Dials), fmt.Sprint(r.Failures)
+			}
+			expiry := "-"
+			if t.TokenExpiry != nil {
+				expiry = "in " + time.Until(*t.TokenExpiry).Round(time.Second).String()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", upstreams, t.Target, t.Transport, expiry, health, dials, failures)
+		}
+		if r.LastError != "" {
+			fmt.Fprintf(tw, "\tlast error: %s\n", r.LastError)
+		}
+	}
+
+	fmt.Fprintln(tw, "\nCONNECTIONS")
+	fmt.Fprintln(tw, "ID\tPRINCIPAL\tSOURCE\tTARGET\tMODE\tAGE\tBYTES UP\tBYTES DOWN")
+	for _, c := range s.Connections {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", c.ID, orDash(c.Principal), orDash(c.Source), c.Target, c.Mode, c.Age, c.BytesUp, c.BytesDown)
+	}
+
+	fmt.Fprintln(tw, "\nRECENT ERRORS")
+	for _, e := range s.Errors {
+		fmt.Fprintf(tw, "%s\t%s\n", e.Time.Local().Format(time.TimeOnly), e.Message)
+	}
+
+	return tw.Flush()
+}
+
+func since(t time.Time) string {
+	return time.Since(t).Round(time.Second).String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
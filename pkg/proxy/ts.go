@@ -13,18 +13,27 @@ const (
 	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
 )
 
-func tokenSource(ctx context.Context, serviceAccount string) (oauth2.TokenSource, error) {
+func tokenSource(ctx context.Context, serviceAccount string) (*meteredTokenSource, error) {
+	var ts oauth2.TokenSource
+	var err error
+
 	if serviceAccount != "" {
-		return impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		ts, err = impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
 			TargetPrincipal: serviceAccount,
 			Scopes:          []string{cloudPlatformScope},
 		})
+	} else {
+		ts, err = google.DefaultTokenSource(ctx)
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
-	return google.DefaultTokenSource(ctx)
+	return &meteredTokenSource{ts: ts, typ: "access"}, nil
 }
 
-func idTokenSource(ctx context.Context, audience string, serviceAccount string) (oauth2.TokenSource, error) {
+func idTokenSource(ctx context.Context, audience string, serviceAccount string) (*meteredTokenSource, error) {
 	if serviceAccount != "" {
 		tokenSource, err := impersonate.IDTokenSource(ctx, impersonate.IDTokenConfig{
 			Audience:        audience,
@@ -43,7 +52,7 @@ func idTokenSource(ctx context.Context, audience string, serviceAccount string)
 			tokenSource = &idTokenFromDefaultTokenSource{ts: tokenSource}
 		}
 
-		return oauth2.ReuseTokenSource(nil, tokenSource), nil
+		return &meteredTokenSource{ts: oauth2.ReuseTokenSource(nil, tokenSource), typ: "id"}, nil
 	}
 
 	tokenSource, err := idtoken.NewTokenSource(ctx, audience)
@@ -56,7 +65,7 @@ func idTokenSource(ctx context.Context, audience string, serviceAccount string)
 		tokenSource = &idTokenFromDefaultTokenSource{ts: tokenSource}
 	}
 
-	return oauth2.ReuseTokenSource(nil, tokenSource), nil
+	return &meteredTokenSource{ts: oauth2.ReuseTokenSource(nil, tokenSource), typ: "id"}, nil
 }
 
 type idTokenFromDefaultTokenSource struct {
@@ -0,0 +1,179 @@
+package remotedialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LeastConnections Strategy = "least-connections"
+	LowestLatency    Strategy = "lowest-latency"
+)
+
+const (
+	ejectAfterFailures = 2
+	minEjectionTime    = 10 * time.Second
+	maxEjectionTime    = 5 * time.Minute
+	latencyWeight      = 0.3
+)
+
+// Balanced returns a Dialer spreading dials over the given dialers according to the strategy.
+// Dialers failing repeatedly are ejected for a while and only tried again when no healthy one is left.
+func Balanced(strategy Strategy, dialers ...Dialer) Dialer {
+	b := &balancedDialer{strategy: strategy, now: time.Now}
+	for _, d := range dialers {
+		b.endpoints = append(b.endpoints, &endpoint{dialer: d})
+	}
+	return b
+}
+
+type endpoint struct {
+	dialer       Dialer
+	active       atomic.Int64
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+	latency      time.Duration
+}
+
+type balancedDialer struct {
+	sync.Mutex
+	strategy  Strategy
+	endpoints []*endpoint
+	next      int
+	now       func() time.Time
+}
+
+func (b *balancedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var errs []error
+
+	endpoints, healthy := b.order()
+	for i, e := range endpoints {
+		// retrying an endpoint only delays failing over when another healthy one is left
+		dialCtx := ctx
+		if i+1 < healthy {
+			dialCtx = withoutRetries(ctx)
+		}
+
+		start := time.Now()
+
+		conn, err := e.dialer.DialContext(dialCtx, network, addr)
+		if err != nil {
+			errs = append(errs, err)
+
+			// a cancelled dial says nothing about the health of the endpoint
+			if ctx.Err() != nil {
+				break
+			}
+
+			b.failed(e)
+			continue
+		}
+
+		b.succeeded(e, time.Since(start))
+
+		e.active.Add(1)
+		return &trackedConn{Conn: conn, release: func() { e.active.Add(-1) }}, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (b *balancedDialer) Close() error {
+	var errs []error
+	for _, e := range b.endpoints {
+		errs = append(errs, Close(e.dialer))
+	}
+	return errors.Join(errs...)
+}
+
+// order returns the healthy endpoints in the order they should be tried, followed by the ejected ones, and how many
+// of them are healthy.
+func (b *balancedDialer) order() ([]*endpoint, int) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := b.now()
+
+	var healthy, ejected []*endpoint
+	for _, e := range b.endpoints {
+		if now.Before(e.ejectedUntil) {
+			ejected = append(ejected, e)
+		} else {
+			healthy = append(healthy, e)
+		}
+	}
+
+	switch b.strategy {
+	case RoundRobin:
+		if len(healthy) > 0 {
+			start := b.next % len(healthy)
+			healthy = append(healthy[start:], healthy[:start]...)
+			b.next++
+		}
+	case LeastConnections:
+		sort.SliceStable(healthy, func(i, j int) bool { return healthy[i].active.Load() < healthy[j].active.Load() })
+	case LowestLatency:
+		sort.SliceStable(healthy, func(i, j int) bool { return healthy[i].latency < healthy[j].latency })
+	}
+
+	sort.SliceStable(ejected, func(i, j int) bool { return ejected[i].ejectedUntil.Before(ejected[j].ejectedUntil) })
+
+	return append(healthy, ejected...), len(healthy)
+}
+
+func (b *balancedDialer) failed(e *endpoint) {
+	b.Lock()
+	defer b.Unlock()
+
+	e.failures++
+	if e.failures < ejectAfterFailures {
+		return
+	}
+
+	ejection := min(minEjectionTime<<e.ejections, maxEjectionTime)
+	e.ejectedUntil = b.now().Add(ejection)
+	e.failures = 0
+
+	if ejection < maxEjectionTime {
+		e.ejections++
+	}
+}
+
+func (b *balancedDialer) succeeded(e *endpoint, latency time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	e.failures = 0
+	e.ejections = 0
+	e.ejectedUntil = time.Time{}
+
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(e.latency))
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,251 @@
+package remotedialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEndpoint records the dials it gets, failing them while it has an error.
+type fakeEndpoint struct {
+	sync.Mutex
+	name      string
+	err       error
+	dials     []string
+	noRetries []bool
+}
+
+func (f *fakeEndpoint) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.dials = append(f.dials, f.name)
+	f.noRetries = append(f.noRetries, !retriesAllowed(ctx))
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	c1, c2 := net.Pipe()
+	_ = c2.Close()
+	return c1, nil
+}
+
+func (f *fakeEndpoint) fail(err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.err = err
+}
+
+// testBalancer returns a balancer over endpoints named a, b, c..., with a clock that only moves when told to.
+func testBalancer(strategy Strategy, n int) (*balancedDialer, []*fakeEndpoint, *time.Time) {
+	var dialers []Dialer
+	var endpoints []*fakeEndpoint
+	for i := range n {
+		e := &fakeEndpoint{name: string(rune('a' + i))}
+		endpoints = append(endpoints, e)
+		dialers = append(dialers, e)
+	}
+
+	now := time.Now()
+	b := Balanced(strategy, dialers...).(*balancedDialer)
+	b.now = func() time.Time { return now }
+
+	return b, endpoints, &now
+}
+
+func dialCounts(endpoints []*fakeEndpoint) []int {
+	var n []int
+	for _, e := range endpoints {
+		e.Lock()
+		n = append(n, len(e.dials))
+		e.Unlock()
+	}
+	return n
+}
+
+func TestBalancerFailover(t *testing.T) {
+	b, endpoints, _ := testBalancer(Failover, 3)
+
+	for range 3 {
+		conn, err := b.DialContext(context.Background(), "tcp", testUpstream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+	}
+	if got := dialCounts(endpoints); !slices.Equal(got, []int{3, 0, 0}) {
+		t.Fatalf("got dials %v, want all of them to the first endpoint", got)
+	}
+
+	endpoints[0].fail(errors.New("refused"))
+	if _, err := b.DialContext(context.Background(), "tcp", testUpstream); err != nil {
+		t.Fatal(err)
+	}
+	if got := dialCounts(endpoints); !slices.Equal(got, []int{4, 1, 0}) {
+		t.Fatalf("got dials %v, want the dial to fail over to the second endpoint", got)
+	}
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b, endpoints, _ := testBalancer(RoundRobin, 3)
+
+	for range 6 {
+		conn, err := b.DialContext(context.Background(), "tcp", testUpstream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+	}
+	if got := dialCounts(endpoints); !slices.Equal(got, []int{2, 2, 2}) {
+		t.Fatalf("got dials %v, want them spread evenly", got)
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b, endpoints, _ := testBalancer(LeastConnections, 3)
+
+	// every open tunnel sends the next one to another endpoint
+	var conns []net.Conn
+	for range 3 {
+		conn, err := b.DialContext(context.Background(), "tcp", testUpstream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	if got := dialCounts(endpoints); !slices.Equal(got, []int{1, 1, 1}) {
+		t.Fatalf("got dials %v, want one to every endpoint", got)
+	}
+
+	// closing the tunnel of the second endpoint makes it the least loaded
+	_ = conns[1].Close()
+	if _, err := b.DialContext(context.Background(), "tcp", testUpstream); err != nil {
+		t.Fatal(err)
+	}
+	if got := dialCounts(endpoints); !slices.Equal(got, []int{1, 2, 1}) {
+		t.Fatalf("got dials %v, want the second endpoint to get the next one", got)
+	}
+}
+
+func TestBalancerLowestLatency(t *testing.T) {
+	b, endpoints, _ := testBalancer(LowestLatency, 3)
+
+	b.succeeded(b.endpoints[0], 30*time.Millisecond)
+	b.succeeded(b.endpoints[1], 10*time.Millisecond)
+	b.succeeded(b.endpoints[2], 20*time.Millisecond)
+
+	// the latency is a moving average, a single slow dial doesn't move an endpoint to the back
+	b.succeeded(b.endpoints[1], 40*time.Millisecond)
+	if l := b.endpoints[1].latency; l != 19*time.Millisecond {
+		t.Fatalf("got latency %v, want %v", l, 19*time.Millisecond)
+	}
+
+	if _, err := b.DialContext(context.Background(), "tcp", testUpstream); err != nil {
+		t.Fatal(err)
+	}
+	if got := dialCounts(endpoints); !slices.Equal(got, []int{0, 1, 0}) {
+		t.Fatalf("got dials %v, want the fastest endpoint to get it", got)
+	}
+}
+
+func TestBalancerEjection(t *testing.T) {
+	b, endpoints, now := testBalancer(Failover, 2)
+	endpoints[0].fail(errors.New("refused"))
+
+	// the first endpoint is ejected once it failed twice in a row
+	for range 2 {
+		if _, err := b.DialContext(context.Background(), "tcp", testUpstream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := dialCounts(endpoints); !slices.Equal(got, []int{2, 2}) {
+		t.Fatalf("got dials %v, want both endpoints dialed twice", got)
+	}
+
+	if _, err := b.DialContext(context.Background(), "tcp", testUpstream); err != nil {
+		t.Fatal(err)
+	}
+	if got := dialCounts(endpoints); !slices.Equal(got, []int{2, 3}) {
+		t.Fatalf("got dials %v, want the ejected endpoint skipped", got)
+	}
+
+	// it is tried again once its ejection is over, and ejected for twice as long when it still fails
+	*now = now.Add(minEjectionTime)
+	for range 2 {
+		if _, err := b.DialContext(context.Background(), "tcp", testUpstream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := dialCounts(endpoints); !slices.Equal(got, []int{4, 5}) {
+		t.Fatalf("got dials %v, want the endpoint tried again", got)
+	}
+
+	*now = now.Add(minEjectionTime)
+	endpoints[0].fail(nil)
+	if _, err := b.DialContext(context.Background(), "tcp", testUpstream); err != nil {
+		t.Fatal(err)
+	}
+	if got := dialCounts(endpoints); !slices.Equal(got, []int{4, 6}) {
+		t.Fatalf("got dials %v, want the endpoint still ejected", got)
+	}
+
+	// a successful dial readmits it for good
+	*now = now.Add(minEjectionTime)
+	if _, err := b.DialContext(context.Background(), "tcp", testUpstream); err != nil {
+		t.Fatal(err)
+	}
+	if got := dialCounts(endpoints); !slices.Equal(got, []int{5, 6}) {
+		t.Fatalf("got dials %v, want the endpoint readmitted", got)
+	}
+	if e := b.endpoints[0]; e.ejections != 0 || !e.ejectedUntil.IsZero() {
+		t.Fatalf("got %d ejections until %v, want them reset", e.ejections, e.ejectedUntil)
+	}
+}
+
+func TestBalancerTriesEjectedWhenNoneHealthy(t *testing.T) {
+	b, endpoints, _ := testBalancer(Failover, 2)
+	for _, e := range endpoints {
+		e.fail(errors.New("refused"))
+	}
+
+	for range 2 {
+		if _, err := b.DialContext(context.Background(), "tcp", testUpstream); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	endpoints[1].fail(nil)
+	if _, err := b.DialContext(context.Background(), "tcp", testUpstream); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBalancerSkipsRetriesWhileOthersHealthy(t *testing.T) {
+	b, endpoints, _ := testBalancer(Failover, 3)
+	for _, e := range endpoints {
+		e.fail(errors.New("refused"))
+	}
+
+	_, _ = b.DialContext(context.Background(), "tcp", testUpstream)
+
+	var noRetries []bool
+	for _, e := range endpoints {
+		noRetries = append(noRetries, e.noRetries...)
+	}
+	if want := []bool{true, true, false}; !slices.Equal(noRetries, want) {
+		t.Fatalf("got retries skipped %v, want %v", noRetries, want)
+	}
+
+	// once no endpoint is healthy, the ejected ones are dialed with retries
+	_, _ = b.DialContext(context.Background(), "tcp", testUpstream)
+	endpoints[0].fail(nil)
+	_, _ = b.DialContext(context.Background(), "tcp", testUpstream)
+
+	if got := endpoints[0].noRetries[2]; got {
+		t.Fatal("got retries skipped without any healthy endpoint")
+	}
+}
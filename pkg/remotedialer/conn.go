@@ -1,28 +1,61 @@
 package remotedialer
 
 import (
+	"errors"
 	"io"
 	"net"
 	"time"
 )
 
+// closeWriter is implemented by connections able to half-close, telling the peer nothing more will be written
+// while still reading what it sends.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// rwcConn is a tunnel to addr, read and written through rwc. Deadlines are those of conn, the connection carrying
+// the tunnel, cw half-closes the tunnel when that is supported.
 type rwcConn struct {
 	addr string
 	rwc  io.ReadWriteCloser
+	conn net.Conn
+	cw   closeWriter
+}
+
+func (conn rwcConn) Read(p []byte) (int, error)  { return conn.rwc.Read(p) }
+func (conn rwcConn) Write(p []byte) (int, error) { return conn.rwc.Write(p) }
+func (conn rwcConn) Close() error                { return conn.rwc.Close() }
+func (conn rwcConn) CloseWrite() error {
+	if conn.cw == nil {
+		return errors.ErrUnsupported
+	}
+	return conn.cw.CloseWrite()
 }
 
-func (conn rwcConn) Read(p []byte) (int, error)         { return conn.rwc.Read(p) }
-func (conn rwcConn) Write(p []byte) (int, error)        { return conn.rwc.Write(p) }
-func (conn rwcConn) Close() error                       { return conn.rwc.Close() }
-func (conn rwcConn) LocalAddr() net.Addr                { return rwcAddr{conn.addr} }
-func (conn rwcConn) RemoteAddr() net.Addr               { return nil }
-func (conn rwcConn) SetDeadline(t time.Time) error      { return nil }
-func (conn rwcConn) SetReadDeadline(t time.Time) error  { return nil }
-func (conn rwcConn) SetWriteDeadline(t time.Time) error { return nil }
+func (conn rwcConn) RemoteAddr() net.Addr               { return rwcAddr{network: "tcp", v: conn.addr} }
+func (conn rwcConn) SetDeadline(t time.Time) error      { return conn.conn.SetDeadline(t) }
+func (conn rwcConn) SetReadDeadline(t time.Time) error  { return conn.conn.SetReadDeadline(t) }
+func (conn rwcConn) SetWriteDeadline(t time.Time) error { return conn.conn.SetWriteDeadline(t) }
+
+// LocalAddr is the address of the TCP connection carrying the tunnel, or the target when the tunnel is carried by
+// something else like an HTTP/2 stream or IAP. Callers like SOCKS5 servers expect a host and port either way.
+func (conn rwcConn) LocalAddr() net.Addr {
+	if addr, ok := conn.conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr
+	}
+	return rwcAddr{network: "tcp", v: conn.addr}
+}
+
+// streamRWCConn returns a tunnel for a stream that is not a connection of its own, adding deadlines to it.
+func streamRWCConn(rwc io.ReadWriteCloser, local net.Addr, addr string) rwcConn {
+	conn := newStreamConn(rwc, local, rwcAddr{network: "tcp", v: addr})
+	return rwcConn{addr: addr, rwc: conn, conn: conn, cw: conn}
+}
 
 type rwcAddr struct {
-	v string
+	network string
+	v       string
 }
 
-func (addr rwcAddr) Network() string { return "tcp" }
+func (addr rwcAddr) Network() string { return addr.network }
 func (addr rwcAddr) String() string  { return addr.v }
@@ -0,0 +1,433 @@
+package remotedialer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/jsiebens/cloud-tunnel/pkg/iap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/nettest"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"nhooyr.io/websocket"
+	"testing"
+	"time"
+)
+
+const testUpstream = "upstream.internal:5432"
+
+func TestStreamConn(t *testing.T) {
+	nettest.TestConn(t, func() (net.Conn, net.Conn, func(), error) {
+		p1, p2 := net.Pipe()
+
+		// hide the deadlines of the pipes, like those of the streams streamConn is used for
+		c1 := newStreamConn(struct{ io.ReadWriteCloser }{p1}, p1.LocalAddr(), p1.RemoteAddr())
+		c2 := newStreamConn(struct{ io.ReadWriteCloser }{p2}, p2.LocalAddr(), p2.RemoteAddr())
+
+		return c1, c2, func() { _ = c1.Close(); _ = c2.Close() }, nil
+	})
+}
+
+func TestUpgradeConn(t *testing.T) {
+	for _, framed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("framed=%t", framed), func(t *testing.T) {
+			dialer, conns := fakeUpgradeServer(t, framed)
+
+			nettest.TestConn(t, func() (net.Conn, net.Conn, func(), error) {
+				c1, err := dialer.DialContext(context.Background(), "tcp", testUpstream)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				c2 := <-conns
+
+				assertHostPort(t, c1.LocalAddr())
+				if c1.RemoteAddr().String() != testUpstream {
+					t.Errorf("got remote address %s, want %s", c1.RemoteAddr(), testUpstream)
+				}
+
+				return c1, c2, func() { _ = c1.Close(); _ = c2.Close() }, nil
+			})
+		})
+	}
+}
+
+func TestUpgradeConnCloseWrite(t *testing.T) {
+	dialer, conns := fakeUpgradeServer(t, true)
+
+	c1, err := dialer.DialContext(context.Background(), "tcp", testUpstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2 := <-conns
+	defer c2.Close()
+
+	if _, err := c1.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.(closeWriter).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server reads until the client is done writing and still gets to answer
+	got, err := io.ReadAll(c2)
+	if err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, %v, want ping", got, err)
+	}
+	if _, err := c2.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c2.(closeWriter).CloseWrite()
+
+	got, err = io.ReadAll(c1)
+	if err != nil || string(got) != "pong" {
+		t.Fatalf("got %q, %v, want pong", got, err)
+	}
+}
+
+func TestMuxStream(t *testing.T) {
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+
+	nettest.TestConn(t, func() (net.Conn, net.Conn, func(), error) {
+		p1, p2 := net.Pipe()
+
+		client, err := yamux.Client(p1, config)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		server, err := yamux.Server(p2, config)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		c2, err := server.AcceptStream()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		c1 := &muxStream{Stream: stream}
+
+		return c1, c2, func() { _ = client.Close(); _ = server.Close() }, nil
+	})
+}
+
+func TestIAPStreamConn(t *testing.T) {
+	client, conns := fakeIAP(t)
+
+	nettest.TestConn(t, func() (net.Conn, net.Conn, func(), error) {
+		conn, err := iap.Dial(context.Background(), nil, iap.DialOptions{
+			Project:    "project",
+			Zone:       "zone",
+			Instance:   "instance",
+			Port:       DefaultServerPort,
+			HTTPClient: client,
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		c1 := iapStreamConn(conn)
+		c2 := <-conns
+
+		return c1, c2, func() { _ = c1.Close(); _ = c2.Close() }, nil
+	})
+}
+
+func TestRWCConnLocalAddr(t *testing.T) {
+	tcp := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+
+	tests := []struct {
+		name  string
+		local net.Addr
+		want  string
+	}{
+		{name: "tcp", local: tcp, want: tcp.String()},
+		{name: "http2", local: rwcAddr{network: string(HTTP2Transport), v: "tunnel.run.app"}, want: testUpstream},
+		{name: "iap", local: iap.Addr{Project: "p", Zone: "z", Instance: "i", Port: DefaultServerPort}, want: testUpstream},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p1, p2 := net.Pipe()
+			defer p2.Close()
+
+			s := newStreamConn(p1, tt.local, nil)
+			defer s.Close()
+
+			conn := rwcConn{addr: testUpstream, rwc: s, conn: s}
+			if got := conn.LocalAddr().String(); got != tt.want {
+				t.Errorf("got local address %s, want %s", got, tt.want)
+			}
+			assertHostPort(t, conn.LocalAddr())
+		})
+	}
+}
+
+func assertHostPort(t *testing.T, addr net.Addr) {
+	t.Helper()
+	if _, _, err := net.SplitHostPort(addr.String()); err != nil {
+		t.Errorf("local address %s is not a host and port: %v", addr, err)
+	}
+}
+
+// fakeUpgradeServer upgrades tunnels like the tunnel server does, passing the server side of every tunnel on the channel.
+func fakeUpgradeServer(t *testing.T, framed bool) (Dialer, chan net.Conn) {
+	conns := make(chan net.Conn, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(UpstreamHeaderName) != testUpstream {
+			http.Error(w, "unexpected upstream", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "upgrade")
+		if framed && IsFramedRequest(req) {
+			w.Header().Set(FramedHeaderName, "true")
+		}
+		w.WriteHeader(http.StatusSwitchingProtocols)
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = brw.Flush()
+
+		if framed {
+			// deadlines on the framed side are handled on top, like for the other streams
+			conn = newStreamConn(Framed(conn), conn.LocalAddr(), conn.RemoteAddr())
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	return RemoteDialer(nil, u, Options{}), conns
+}
+
+// fakeHTTP2Server accepts HTTP/2 CONNECT tunnels over h2c, running the handler for the server side of every tunnel.
+func fakeHTTP2Server(t *testing.T, handle func(conn io.ReadWriteCloser)) Dialer {
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := AcceptHTTP2(w, req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		handle(conn)
+	}), &http2.Server{}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	d := RemoteDialer(nil, u, Options{Transport: HTTP2Transport})
+	t.Cleanup(func() { _ = Close(d) })
+	return d
+}
+
+// fakeIAP serves the IAP relay protocol, passing the instance side of every connection on the channel.
+func fakeIAP(t *testing.T) (*http.Client, chan net.Conn) {
+	conns := make(chan net.Conn, 1)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := websocket.Accept(w, req, &websocket.AcceptOptions{
+			Subprotocols:       []string{"relay.tunnel.cloudproxy.app"},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+
+		ctx := context.Background()
+		instance, conn := net.Pipe()
+
+		session := []byte("session")
+		if err := ws.Write(ctx, websocket.MessageBinary, append(iapFrameHeader(0x1, len(session)), session...)); err != nil {
+			return
+		}
+
+		conns <- conn
+
+		// the relay is closed once the instance side is, and the handler may only return after that
+		done := make(chan struct{})
+		defer func() { <-done }()
+
+		go func() {
+			defer close(done)
+			defer ws.Close(websocket.StatusNormalClosure, "")
+			buf := make([]byte, 16384)
+			for {
+				n, err := instance.Read(buf)
+				if err != nil {
+					return
+				}
+				if err := ws.Write(ctx, websocket.MessageBinary, append(iapFrameHeader(0x4, n), buf[:n]...)); err != nil {
+					return
+				}
+			}
+		}()
+
+		// every frame is a message of its own
+		defer instance.Close()
+		for {
+			_, frame, err := ws.Read(ctx)
+			if err != nil {
+				return
+			}
+
+			switch tag := binary.BigEndian.Uint16(frame); tag {
+			case 0x4:
+				if _, err := instance.Write(frame[6:]); err != nil {
+					return
+				}
+			case 0x7:
+			default:
+				t.Errorf("unexpected frame tag %x", tag)
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	tr := server.Client().Transport.(*http.Transport).Clone()
+	tr.TLSClientConfig.ServerName = "example.com"
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+
+	return &http.Client{Transport: tr}, conns
+}
+
+func iapFrameHeader(tag uint16, n int) []byte {
+	b := make([]byte, 6)
+	binary.BigEndian.PutUint16(b, tag)
+	binary.BigEndian.PutUint32(b[2:], uint32(n))
+	return b
+}
+
+func TestHTTP2ConnCloseWrite(t *testing.T) {
+	received := make(chan string, 1)
+
+	dialer := fakeHTTP2Server(t, func(conn io.ReadWriteCloser) {
+		// the server is done writing before the client is
+		_, _ = conn.Write([]byte("pong"))
+		if err := conn.(closeWriter).CloseWrite(); err != nil {
+			t.Error(err)
+		}
+
+		got, _ := io.ReadAll(conn)
+		received <- string(got)
+	})
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", testUpstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "pong" {
+		t.Fatalf("got %q, %v, want pong", got, err)
+	}
+
+	// the client still gets to write once the server half-closed the stream
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(closeWriter).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if got != "ping" {
+			t.Fatalf("server got %q, want ping", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still reading")
+	}
+}
+
+func TestGRPCConnCloseWrite(t *testing.T) {
+	received := make(chan string, 1)
+
+	server := NewGRPCServer(func(target string, stream *GRPCStream) error {
+		if err := stream.Accept(); err != nil {
+			return err
+		}
+
+		// the server is done writing before the client is
+		_, _ = stream.Write([]byte("pong"))
+		if err := stream.CloseWrite(); err != nil {
+			t.Error(err)
+		}
+
+		got, _ := io.ReadAll(stream)
+		received <- string(got)
+		return nil
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(server.Stop)
+
+	dialer := RemoteDialer(nil, &url.URL{Scheme: "http", Host: ln.Addr().String()}, Options{Transport: GRPCTransport})
+	t.Cleanup(func() { _ = Close(dialer) })
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", testUpstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "pong" {
+		t.Fatalf("got %q, %v, want pong", got, err)
+	}
+
+	// the client still gets to write once the server half-closed the stream
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(closeWriter).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if got != "ping" {
+			t.Fatalf("server got %q, want ping", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still reading")
+	}
+}
+
+func TestChunkCodec(t *testing.T) {
+	for _, c := range []chunk{{data: []byte("data")}, {closeWrite: true}, {data: []byte("last"), closeWrite: true}} {
+		b, err := chunkCodec{}.Marshal(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := chunk{}
+		if err := (chunkCodec{}).Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got.data) != string(c.data) || got.closeWrite != c.closeWrite {
+			t.Fatalf("got %+v, want %+v", got, c)
+		}
+	}
+}
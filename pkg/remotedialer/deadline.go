@@ -0,0 +1,307 @@
+package remotedialer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	streamReadSize      = 32 * 1024
+	streamLingerTimeout = 5 * time.Second
+)
+
+// deadline is closed once the deadline passes, the way net.Pipe implements its deadlines.
+type deadline struct {
+	sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// streamConn adds deadlines to streams that either have none, like HTTP/2 and gRPC streams, or are closed
+// when a deadline passes, like WebSocket connections. Reads and writes are handed to goroutines of their own
+// so a call can give up when its deadline passes while the stream itself is left untouched.
+type streamConn struct {
+	rwc    io.ReadWriteCloser
+	local  net.Addr
+	remote net.Addr
+
+	reads    chan readResult
+	consumed chan struct{}
+	pending  []byte
+	readErr  error
+	readMu   sync.Mutex
+
+	writes   chan []byte
+	written  chan error
+	writing  bool
+	writeBuf []byte
+	writeMu  sync.Mutex
+	writeErr error
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newStreamConn(rwc io.ReadWriteCloser, local, remote net.Addr) *streamConn {
+	c := &streamConn{
+		rwc:           rwc,
+		local:         local,
+		remote:        remote,
+		reads:         make(chan readResult),
+		consumed:      make(chan struct{}, 1),
+		writes:        make(chan []byte),
+		written:       make(chan error, 1),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closed:        make(chan struct{}),
+	}
+
+	go c.readLoop()
+	go c.writeLoop()
+
+	return c
+}
+
+func (c *streamConn) readLoop() {
+	buf := make([]byte, streamReadSize)
+
+	for {
+		n, err := c.rwc.Read(buf)
+
+		select {
+		case c.reads <- readResult{data: buf[:n], err: err}:
+		case <-c.closed:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		// the buffer is reused once the reader is done with it
+		select {
+		case <-c.consumed:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *streamConn) writeLoop() {
+	for {
+		select {
+		case p := <-c.writes:
+			_, err := c.rwc.Write(p)
+			c.written <- err
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if isClosedChan(c.readDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if len(c.pending) == 0 && c.readErr == nil {
+		select {
+		case r := <-c.reads:
+			c.pending, c.readErr = r.data, r.err
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if len(c.pending) == 0 && c.readErr == nil {
+			c.consumed <- struct{}{}
+			return 0, nil
+		}
+	}
+
+	if len(c.pending) == 0 {
+		return 0, c.readErr
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	if len(c.pending) == 0 && c.readErr == nil {
+		c.consumed <- struct{}{}
+	}
+
+	return n, nil
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if isClosedChan(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if err := c.awaitWrite(); err != nil {
+		return 0, err
+	}
+
+	// a write giving up at its deadline is still completed in the background, so it can't keep using p. The
+	// buffer it uses instead is reused, a write only starts once the previous one is completed.
+	c.writeBuf = append(c.writeBuf[:0], p...)
+
+	select {
+	case c.writes <- c.writeBuf:
+		c.writing = true
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if err := c.awaitWrite(); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// awaitWrite waits for the write in progress, if any, to complete.
+func (c *streamConn) awaitWrite() error {
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+
+	if !c.writing {
+		return nil
+	}
+
+	select {
+	case err := <-c.written:
+		c.writing = false
+		c.writeErr = err
+		return err
+	case <-c.closed:
+		return net.ErrClosed
+	case <-c.writeDeadline.wait():
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// CloseWrite half-closes the stream once the write in progress, if any, is completed.
+func (c *streamConn) CloseWrite() error {
+	cw, ok := c.rwc.(closeWriter)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.awaitWrite(); err != nil {
+		return err
+	}
+
+	return cw.CloseWrite()
+}
+
+func (c *streamConn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.rwc.Close()
+	})
+	return err
+}
+
+// Expiry passes on the expiry of the stream, if it has one.
+func (c *streamConn) Expiry() time.Time {
+	if e, ok := c.rwc.(expirer); ok {
+		return e.Expiry()
+	}
+	return time.Time{}
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
@@ -2,62 +2,145 @@ package remotedialer
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/hashicorp/yamux"
 	"github.com/jsiebens/cloud-tunnel/pkg/iap"
+	"github.com/jsiebens/cloud-tunnel/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
 	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
-	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	AuthorizationHeaderName = "Authorization"
 	UpstreamHeaderName      = "X-Cloud-Tunnel-Upstream"
+	DeferredHeaderName      = "X-Cloud-Tunnel-Deferred-Upstream"
+	ConnectionIDHeaderName  = "X-Cloud-Tunnel-Connection-Id"
 	DefaultServerPort       = 7654
 )
 
+var tracer = otel.Tracer("github.com/jsiebens/cloud-tunnel/pkg/remotedialer")
+
+type Strategy string
+
+const (
+	Failover   Strategy = "failover"
+	RoundRobin Strategy = "round-robin"
+)
+
 type Dialer interface {
 	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
-func RemoteDialer(ts oauth2.TokenSource, url *url.URL, mux bool) Dialer {
+// Close stops what the dialer runs in the background, like filling a pool of pre-warmed connections,
+// for dialers that do.
+func Close(d Dialer) error {
+	if c, ok := d.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Probe opens a tunnel without upstream and closes it right away, checking the server and whatever is in front of it
+// accept tunnels of this dialer without dialing anything on the side of the server.
+func Probe(ctx context.Context, d Dialer) error {
+	switch d := d.(type) {
+	case *pooledDialer:
+		return d.remote.probe(ctx)
+	case *remoteDialer:
+		return d.probe(ctx)
+	}
+	return errors.ErrUnsupported
+}
+
+type Transport string
+
+const (
+	UpgradeTransport   Transport = "upgrade"
+	WebSocketTransport Transport = "websocket"
+	HTTP2Transport     Transport = "http2"
+	GRPCTransport      Transport = "grpc"
+)
+
+type Options struct {
+	Transport   Transport
+	Mux         bool
+	MuxOptions  MuxOptions
+	Retry       RetryPolicy
+	PoolSize    int
+	PoolMaxIdle time.Duration
+}
+
+func RemoteDialer(ts oauth2.TokenSource, url *url.URL, opts Options) Dialer {
 	dialer := Dialer(&net.Dialer{})
-	if mux {
-		dialer = muxed(dialer)
+	if opts.Mux {
+		dialer = muxed(dialer, opts.MuxOptions)
 	}
 
-	return &remoteDialer{url: url, ts: ts, dialer: dialer}
+	return newRemoteDialer(ts, url, dialer, opts)
 }
 
-func IAPRemoteDialer(ts oauth2.TokenSource, instance string, port int, project, zone string, mux bool) Dialer {
+func IAPRemoteDialer(ts oauth2.TokenSource, instances iap.Instances, port int, strategy Strategy, opts Options) Dialer {
 	if port == 0 {
 		port = DefaultServerPort
 	}
 
 	u, _ := url.Parse("http://unused")
 
-	opts := iap.DialOptions{
-		Project:  project,
-		Zone:     zone,
-		Instance: instance,
-		Port:     port,
+	dialer := Dialer(&iapDialer{ts: ts, instances: instances, port: port, strategy: strategy})
+	if opts.Mux {
+		dialer = muxed(dialer, opts.MuxOptions)
 	}
 
-	dialer := Dialer(&iapDialer{ts, opts})
-	if mux {
-		dialer = muxed(dialer)
+	return newRemoteDialer(ts, u, dialer, opts)
+}
+
+func newRemoteDialer(ts oauth2.TokenSource, url *url.URL, dialer Dialer, opts Options) Dialer {
+	if opts.Transport == "" {
+		opts.Transport = UpgradeTransport
 	}
 
-	return &remoteDialer{url: u, ts: ts, dialer: dialer}
+	r := &remoteDialer{url: url, ts: ts, dialer: dialer, transport: opts.Transport, retry: opts.Retry.withDefaults()}
+
+	if opts.Transport == HTTP2Transport {
+		r.h2 = newHTTP2Transport(url, dialer)
+	}
+
+	if opts.Transport == GRPCTransport {
+		r.grpc, r.err = newGRPCClient(url, dialer)
+	}
+
+	// a muxed dialer already reuses its connection, pooling only pays off for one connection per tunnel,
+	// gRPC streams can't be opened before their upstream is known
+	if opts.PoolSize > 0 && !opts.Mux && opts.Transport != GRPCTransport {
+		return pooled(r, opts.PoolSize, opts.PoolMaxIdle)
+	}
+
+	return r
 }
 
 type remoteDialer struct {
-	url    *url.URL
-	ts     oauth2.TokenSource
-	dialer Dialer
+	url       *url.URL
+	ts        oauth2.TokenSource
+	dialer    Dialer
+	transport Transport
+	h2        *http2.Transport
+	grpc      *grpc.ClientConn
+	retry     RetryPolicy
+	err       error
 }
 
 func (r *remoteDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -65,98 +148,227 @@ func (r *remoteDialer) DialContext(ctx context.Context, network, addr string) (n
 		return nil, fmt.Errorf("unsupported network '%s'", network)
 	}
 
-	tr := http.DefaultTransport.(*http.Transport).Clone()
-	if r.dialer != nil {
-		tr.DialContext = r.dialer.DialContext
+	ctx, span := r.startSpan(ctx, addr)
+	start := time.Now()
+	conn, err := r.dial(ctx, addr)
+	r.observe(start, err)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
 	}
-	defer tr.CloseIdleConnections()
 
-	req := &http.Request{
-		Method: "GET",
-		URL:    r.url,
-		Header: http.Header{
-			"Upgrade":          []string{"websocket"},
-			"Connection":       []string{"upgrade"},
-			UpstreamHeaderName: []string{addr},
-		},
+	return conn, nil
+}
+
+func (r *remoteDialer) dial(ctx context.Context, addr string) (rwcConn, error) {
+	var conn rwcConn
+	err := withRetries(ctx, r.retry, func() (err error) {
+		conn, err = r.upgrade(ctx, addr)
+		return err
+	})
+	return conn, err
+}
+
+func (r *remoteDialer) probe(ctx context.Context) error {
+	conn, err := r.upgrade(ctx, "")
+	// gRPC streams can't be deferred, the server refusing a stream for its missing upstream means it was reached
+	if r.transport == GRPCTransport && status.Code(err) == codes.InvalidArgument {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (r *remoteDialer) startSpan(ctx context.Context, addr string) (context.Context, trace.Span) {
+	if info := dialInfo(ctx); info != nil {
+		info.Transport = r.transport
+	}
+
+	return tracer.Start(ctx, "tunnel.dial", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("tunnel.upstream", addr),
+		attribute.String("tunnel.transport", string(r.transport)),
+	))
+}
+
+func (r *remoteDialer) observe(start time.Time, err error) {
+	dials.WithLabelValues(string(r.transport), result(err)).Inc()
+	dialDuration.WithLabelValues(string(r.transport)).Observe(time.Since(start).Seconds())
+}
+
+// upgrade opens a tunnel to the upstream, or a deferred one when no upstream is given.
+func (r *remoteDialer) upgrade(ctx context.Context, addr string) (rwcConn, error) {
+	if r.err != nil {
+		return rwcConn{}, r.err
+	}
+
+	header := http.Header{}
+
+	if addr != "" {
+		header.Set(UpstreamHeaderName, addr)
+	} else {
+		header.Set(DeferredHeaderName, "true")
+	}
+
+	info := dialInfo(ctx)
+	if info != nil && info.ConnectionID != "" {
+		header.Set(ConnectionIDHeaderName, info.ConnectionID)
 	}
 
 	if r.ts != nil {
+		_, span := tracer.Start(ctx, "tunnel.token")
 		token, err := r.ts.Token()
+		tracing.End(span, err)
 		if err != nil {
-			return nil, err
+			return rwcConn{}, err
 		}
-		req.Header.Set(AuthorizationHeaderName, "Bearer "+token.AccessToken)
+		header.Set(AuthorizationHeaderName, "Bearer "+token.AccessToken)
+	}
+
+	if info != nil {
+		info.Principal = Principal(header.Get(AuthorizationHeaderName))
+	}
+
+	ctx, span := tracer.Start(ctx, "tunnel.handshake")
+	// the server continues the trace of the tunnel
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+
+	slog.Debug("Opening tunnel", "addr", addr, "server", r.url.Host, "transport", r.transport)
+
+	conn, err := r.handshake(ctx, header, addr)
+	tracing.End(span, err)
+	if err != nil {
+		slog.Debug("Unable to open tunnel", "addr", addr, "server", r.url.Host, "transport", r.transport, "err", err)
+		return conn, err
+	}
+
+	slog.Debug("Opened tunnel", "addr", addr, "server", r.url.Host, "transport", r.transport)
+	return conn, nil
+}
+
+// handshake opens the tunnel with the transport of the dialer.
+func (r *remoteDialer) handshake(ctx context.Context, header http.Header, addr string) (rwcConn, error) {
+	if r.transport == HTTP2Transport {
+		return r.dialHTTP2(ctx, header, addr)
+	}
+
+	if r.transport == GRPCTransport {
+		return r.dialGRPC(ctx, header, addr)
+	}
+
+	// the transport dials a single connection, the one carrying the tunnel
+	var raw net.Conn
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := r.dialer.DialContext(ctx, network, addr)
+		raw = conn
+		return conn, err
+	}
+	defer tr.CloseIdleConnections()
+
+	if r.transport == WebSocketTransport {
+		return r.dialWebSocket(ctx, tr, header, addr, func() net.Conn { return raw })
+	}
+
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "upgrade")
+	header.Set(FramedHeaderName, "true")
+
+	req := &http.Request{
+		Method: "GET",
+		URL:    r.url,
+		Header: header,
 	}
 
 	resp, err := tr.RoundTrip(req.WithContext(ctx))
 	if err != nil {
-		return nil, err
+		return rwcConn{}, err
 	}
 
 	if resp.StatusCode != http.StatusSwitchingProtocols {
-		return nil, fmt.Errorf("invalid response: %s", resp.Status)
+		_ = resp.Body.Close()
+		return rwcConn{}, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
-	return rwcConn{rwc: resp.Body.(io.ReadWriteCloser), addr: addr}, nil
-}
+	// the tunnel is half-closed in-band when the server frames it, deadlines are handled on top so none interrupts a frame
+	if resp.Header.Get(FramedHeaderName) == "true" {
+		return streamRWCConn(&framedStream{rwc: resp.Body.(io.ReadWriteCloser)}, raw.LocalAddr(), addr), nil
+	}
 
-type iapDialer struct {
-	ts   oauth2.TokenSource
-	opts iap.DialOptions
-}
+	conn := rwcConn{rwc: resp.Body.(io.ReadWriteCloser), conn: raw, addr: addr}
 
-func (i *iapDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
-	return iap.Dial(ctx, i.ts, i.opts)
-}
+	// servers not framing the tunnel only allow half-closing the raw connection, over TLS that would break the TLS stream instead
+	if cw, ok := raw.(closeWriter); ok && r.url.Scheme != "https" {
+		conn.cw = cw
+	}
 
-func muxed(dialer Dialer) Dialer {
-	return &muxedDialer{dialer: dialer, sessions: make(map[string]*yamux.Session)}
+	return conn, nil
 }
 
-type muxedDialer struct {
-	sync.RWMutex
-	dialer   Dialer
-	sessions map[string]*yamux.Session
+type iapDialer struct {
+	ts        oauth2.TokenSource
+	instances iap.Instances
+	port      int
+	strategy  Strategy
+	next      atomic.Uint64
 }
 
-func (i *muxedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	session, err := i.getSession(ctx, network, addr)
+func (i *iapDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	instances, err := i.instances.Instances(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return session.Open()
-}
 
-func (i *muxedDialer) getSession(ctx context.Context, network, addr string) (*yamux.Session, error) {
-	k := fmt.Sprintf("%s|%s", network, addr)
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no instances available")
+	}
 
-	i.RLock()
-	{
-		session := i.sessions[k]
-		if session != nil && !session.IsClosed() {
-			i.RUnlock()
-			return session, nil
-		}
+	start := 0
+	if i.strategy == RoundRobin {
+		start = int((i.next.Add(1) - 1) % uint64(len(instances)))
 	}
-	i.RUnlock()
 
-	i.Lock()
-	defer i.Unlock()
+	var errs []error
+	for n := range instances {
+		instance := instances[(start+n)%len(instances)]
 
-	session := i.sessions[k]
-	if session != nil && !session.IsClosed() {
-		return session, nil
-	}
+		opts := iap.DialOptions{
+			Project:  instance.Project,
+			Zone:     instance.Zone,
+			Instance: instance.Name,
+			Port:     i.port,
+		}
 
-	conn, err := i.dialer.DialContext(ctx, network, addr)
-	if err != nil {
-		return nil, err
-	}
+		_, span := tracer.Start(ctx, "iap.connect", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+			attribute.String("iap.project", instance.Project),
+			attribute.String("iap.zone", instance.Zone),
+			attribute.String("iap.instance", instance.Name),
+			attribute.Int("iap.port", i.port),
+		))
+		slog.Debug("Connecting to instance through IAP", "project", instance.Project, "zone", instance.Zone, "instance", instance.Name, "port", i.port)
+		conn, err := iap.Dial(ctx, i.ts, opts)
+		tracing.End(span, err)
+		if err == nil {
+			return iapStreamConn(conn), nil
+		}
 
-	if i.sessions[k], err = yamux.Client(conn, nil); err != nil {
-		return nil, err
+		errs = append(errs, err)
+
+		if inv, ok := i.instances.(iap.Invalidator); ok && errors.Is(err, iap.ErrInstanceNotFound) {
+			inv.Invalidate()
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
 	}
 
-	return i.sessions[k], nil
+	return nil, errors.Join(errs...)
+}
+
+// iapStreamConn handles deadlines on top of an IAP connection, deadlines on the underlying WebSocket close it.
+func iapStreamConn(conn *iap.Conn) net.Conn {
+	return newStreamConn(conn, conn.LocalAddr(), conn.RemoteAddr())
 }
@@ -0,0 +1,15 @@
+package remotedialer
+
+import (
+	"errors"
+	"github.com/jsiebens/cloud-tunnel/pkg/iap"
+)
+
+// Hint returns a remediation for a dial error, or an empty string when there is none.
+func Hint(err error) string {
+	var iapErr *iap.Error
+	if errors.As(err, &iapErr) {
+		return iapErr.Hint()
+	}
+	return ""
+}
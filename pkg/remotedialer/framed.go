@@ -0,0 +1,108 @@
+package remotedialer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// FramedHeaderName asks for an upgraded tunnel to be framed, the server confirms it by setting it on its response.
+// Framing lets either side half-close the tunnel when the connection carrying it can't, like a TLS connection or IAP.
+const FramedHeaderName = "X-Cloud-Tunnel-Framed"
+
+// Each frame is a type, a 2-byte length and that many bytes of data. A close-write frame, like closeWriteMessage
+// for WebSockets, tells the peer nothing more will be written.
+const (
+	frameData byte = iota
+	frameCloseWrite
+)
+
+const (
+	frameHeaderSize = 3
+	maxFrameSize    = 1<<16 - 1
+)
+
+// IsFramedRequest reports whether the client asks for the upgraded tunnel to be framed.
+func IsFramedRequest(req *http.Request) bool {
+	return req.Header.Get(FramedHeaderName) == "true"
+}
+
+// Framed reads and writes an upgraded tunnel as frames, once the server confirmed the client asked for it.
+func Framed(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &framedStream{rwc: rwc}
+}
+
+// framedStream has no deadlines, as a deadline interrupting a frame would leave the stream unusable.
+type framedStream struct {
+	rwc       io.ReadWriteCloser
+	header    [frameHeaderSize]byte
+	remaining int
+	eof       bool
+	writeMu   sync.Mutex
+	writeBuf  []byte
+}
+
+func (s *framedStream) Read(p []byte) (int, error) {
+	for s.remaining == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+
+		if _, err := io.ReadFull(s.rwc, s.header[:]); err != nil {
+			return 0, err
+		}
+
+		switch s.header[0] {
+		case frameData:
+			s.remaining = int(binary.BigEndian.Uint16(s.header[1:]))
+		case frameCloseWrite:
+			s.eof = true
+		default:
+			return 0, fmt.Errorf("unknown frame type %d", s.header[0])
+		}
+	}
+
+	n, err := s.rwc.Read(p[:min(len(p), s.remaining)])
+	s.remaining -= n
+	return n, err
+}
+
+func (s *framedStream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), maxFrameSize)
+		if err := s.writeFrame(frameData, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (s *framedStream) CloseWrite() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return s.writeFrame(frameCloseWrite, nil)
+}
+
+func (s *framedStream) Close() error {
+	return s.rwc.Close()
+}
+
+// writeFrame writes the header and data of a frame at once, so it isn't split over TLS records or HTTP/2 frames.
+// The buffer is reused for every frame, as the write lock is held until the frame is written.
+func (s *framedStream) writeFrame(typ byte, data []byte) error {
+	s.writeBuf = append(append(s.writeBuf[:0], typ, 0, 0), data...)
+	binary.BigEndian.PutUint16(s.writeBuf[1:], uint16(len(data)))
+
+	_, err := s.rwc.Write(s.writeBuf)
+	return err
+}
@@ -0,0 +1,394 @@
+package remotedialer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each tunnel is a bidirectional stream of the cloudtunnel.v1.Tunnel/Stream method, both directions carrying
+//
+//	message Chunk { bytes data = 1; bool close_write = 2; }
+//
+// The upstream and authorization are passed as metadata, the server sends its headers once the upstream is dialed.
+// The server can only end the stream as a whole, so it half-closes it with a close_write chunk for clients
+// announcing they understand it.
+
+const (
+	grpcServiceName   = "cloudtunnel.v1.Tunnel"
+	grpcStreamMethod  = "/" + grpcServiceName + "/Stream"
+	grpcEstablishedMD = "x-cloud-tunnel-established"
+	grpcCloseWriteMD  = "x-cloud-tunnel-close-write"
+)
+
+var grpcStreamDesc = grpc.StreamDesc{
+	StreamName:    "Stream",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+type chunk struct {
+	data       []byte
+	closeWrite bool
+}
+
+// chunkCodec encodes chunks in the protobuf wire format without the need for generated code.
+type chunkCodec struct{}
+
+func (chunkCodec) Name() string { return "proto" }
+
+func (chunkCodec) Marshal(v any) ([]byte, error) {
+	c, ok := v.(*chunk)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, c.data)
+	if c.closeWrite {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return b, nil
+}
+
+func (chunkCodec) Unmarshal(b []byte, v any) error {
+	c, ok := v.(*chunk)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+
+	c.data = c.data[:0]
+	c.closeWrite = false
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if num == 1 && typ == protowire.BytesType {
+			data, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			c.data = append(c.data, data...)
+			b = b[n:]
+			continue
+		}
+
+		if num == 2 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			c.closeWrite = v != 0
+			b = b[n:]
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
+
+// newGRPCClient returns a client connection multiplexing all tunnel streams, using TLS when the server url is https.
+func newGRPCClient(u *url.URL, dialer Dialer) (*grpc.ClientConn, error) {
+	target := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		target = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	creds := insecure.NewCredentials()
+	if u.Scheme == "https" {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+
+	return grpc.NewClient("passthrough:///"+target,
+		grpc.WithAuthority(u.Host),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		}),
+	)
+}
+
+// dialGRPC opens the tunnel as a bidirectional stream on the shared gRPC connection.
+// Streams always carry their upstream, the server refuses those without one.
+func (r *remoteDialer) dialGRPC(ctx context.Context, header http.Header, addr string) (rwcConn, error) {
+	md := metadata.MD{}
+	for k, v := range header {
+		md.Set(k, v...)
+	}
+	md.Set(grpcCloseWriteMD, "true")
+
+	// the stream has to outlive the dial, only the dial itself is bound to the context
+	streamCtx, cancel := context.WithCancel(metadata.NewOutgoingContext(context.Background(), md))
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	stream, err := r.grpc.NewStream(streamCtx, &grpcStreamDesc, grpcStreamMethod, grpc.ForceCodec(chunkCodec{}))
+	if err != nil {
+		cancel()
+		return rwcConn{}, grpcError(err)
+	}
+
+	// a stream failing before the upstream is dialed ends without headers, its status is found by receiving
+	h, err := stream.Header()
+	if err == nil && len(h.Get(grpcEstablishedMD)) == 0 {
+		err = stream.RecvMsg(&chunk{})
+		if err == nil || err == io.EOF {
+			err = errors.New("tunnel stream ended before it was established")
+		}
+	}
+	if err != nil {
+		cancel()
+		return rwcConn{}, grpcError(err)
+	}
+
+	return streamRWCConn(&grpcStream{stream: stream, cancel: cancel}, rwcAddr{network: string(GRPCTransport), v: r.url.Host}, addr), nil
+}
+
+// grpcError maps the status the server ends a stream with to the errors of the other transports.
+func grpcError(err error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	switch s.Code() {
+	case codes.PermissionDenied:
+		return ErrUpstreamNotAllowed
+	case codes.Aborted:
+		return &UpstreamError{Message: s.Message()}
+	case codes.ResourceExhausted:
+		return &StatusError{StatusCode: http.StatusTooManyRequests, Status: "429 " + http.StatusText(http.StatusTooManyRequests)}
+	}
+
+	return err
+}
+
+type grpcStream struct {
+	sync.Mutex
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	buf    []byte
+	eof    bool
+}
+
+func (s *grpcStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		// the server half-closed the stream, which stays open for writing
+		if s.eof {
+			return 0, io.EOF
+		}
+
+		c := chunk{}
+		if err := s.stream.RecvMsg(&c); err != nil {
+			return 0, err
+		}
+		s.buf = c.data
+		s.eof = c.closeWrite
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *grpcStream) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.stream.SendMsg(&chunk{data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *grpcStream) CloseWrite() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.stream.CloseSend()
+}
+
+// Close half-closes the stream, it is only cancelled once the server had the time to receive what was written.
+func (s *grpcStream) Close() error {
+	// CloseSend must not race a SendMsg, which may be blocked on flow control until the stream is cancelled
+	go func() {
+		s.Lock()
+		defer s.Unlock()
+		_ = s.stream.CloseSend()
+	}()
+
+	time.AfterFunc(streamLingerTimeout, s.cancel)
+	return nil
+}
+
+// IsGRPCRequest reports whether the request is a gRPC call, to be handed to the server returned by NewGRPCServer.
+func IsGRPCRequest(req *http.Request) bool {
+	return req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// GRPCHandler handles a tunnel stream for the given upstream. It returns ErrUpstreamNotAllowed or an UpstreamError
+// when the upstream can't be used, otherwise it calls Accept once the upstream is dialed and keeps running for
+// as long as the stream is in use.
+type GRPCHandler func(target string, stream *GRPCStream) error
+
+type grpcTunnelService interface{}
+
+// NewGRPCServer returns a gRPC server serving the tunnel service with the given handler.
+func NewGRPCServer(handler GRPCHandler) *grpc.Server {
+	server := grpc.NewServer(grpc.ForceServerCodec(chunkCodec{}))
+
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: grpcServiceName,
+		HandlerType: (*grpcTunnelService)(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    grpcStreamDesc.StreamName,
+			ServerStreams: true,
+			ClientStreams: true,
+			Handler: func(_ any, stream grpc.ServerStream) error {
+				s := &GRPCStream{stream: stream}
+
+				target := s.Header(UpstreamHeaderName)
+				if target == "" {
+					return status.Error(codes.InvalidArgument, "missing target header")
+				}
+
+				err := handler(target, s)
+				s.close()
+
+				var upstreamErr *UpstreamError
+				switch {
+				case errors.Is(err, ErrUpstreamNotAllowed):
+					return status.Error(codes.PermissionDenied, err.Error())
+				case errors.Is(err, ErrLimitExceeded):
+					return status.Error(codes.ResourceExhausted, err.Error())
+				case errors.Is(err, ErrDraining):
+					return status.Error(codes.Unavailable, err.Error())
+				case errors.As(err, &upstreamErr):
+					return status.Error(codes.Aborted, upstreamErr.Message)
+				}
+				return err
+			},
+		}},
+	}, struct{}{})
+
+	return server
+}
+
+// GRPCStream is the server side of a tunnel stream.
+type GRPCStream struct {
+	sync.Mutex
+	stream grpc.ServerStream
+	buf    []byte
+	closed bool
+}
+
+// Header returns the first value of the request metadata with the given name.
+func (s *GRPCStream) Header(name string) string {
+	if md, ok := metadata.FromIncomingContext(s.stream.Context()); ok {
+		if v := md.Get(name); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// RemoteAddr returns the address of the client of the stream.
+func (s *GRPCStream) RemoteAddr() net.Addr {
+	if p, ok := peer.FromContext(s.stream.Context()); ok {
+		return p.Addr
+	}
+	return nil
+}
+
+// Accept tells the client the tunnel is established.
+func (s *GRPCStream) Accept() error {
+	return s.stream.SendHeader(metadata.Pairs(grpcEstablishedMD, "true"))
+}
+
+func (s *GRPCStream) Read(p []byte) (int, error) {
+	if len(s.buf) == 0 {
+		c := chunk{}
+		if err := s.stream.RecvMsg(&c); err != nil {
+			return 0, err
+		}
+		s.buf = c.data
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *GRPCStream) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// the stream must not be used once the handler has returned, so no write may outlive Close
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+
+	if err := s.stream.SendMsg(&chunk{data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite half-closes the stream for clients understanding a close_write chunk, the stream itself only ends
+// when the handler returns.
+func (s *GRPCStream) CloseWrite() error {
+	if s.Header(grpcCloseWriteMD) != "true" {
+		return errors.ErrUnsupported
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return net.ErrClosed
+	}
+	s.closed = true
+
+	return s.stream.SendMsg(&chunk{closeWrite: true})
+}
+
+// Close stops writes to the stream, the stream itself ends when the handler returns.
+func (s *GRPCStream) Close() error {
+	s.close()
+	return nil
+}
+
+func (s *GRPCStream) close() {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+}
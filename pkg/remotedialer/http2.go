@@ -0,0 +1,166 @@
+package remotedialer
+
+import (
+	"context"
+	"crypto/tls"
+	"golang.org/x/net/http2"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// newHTTP2Transport returns a transport multiplexing all tunnel streams on a single HTTP/2 connection,
+// using h2c when the server url is plain http.
+func newHTTP2Transport(u *url.URL, dialer Dialer) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || u.Scheme != "https" {
+				return conn, err
+			}
+
+			tlsConn := tls.Client(conn, cfg)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+
+			return tlsConn, nil
+		},
+	}
+}
+
+// dialHTTP2 opens the tunnel as a CONNECT stream on the shared HTTP/2 connection. The authority remains the
+// tunnel server so the request is routed like any other, the upstream is passed in a header as with an upgrade.
+func (r *remoteDialer) dialHTTP2(ctx context.Context, header http.Header, addr string) (rwcConn, error) {
+	// the stream has to outlive the dial, only the dial itself is bound to the context
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	pr, pw := io.Pipe()
+
+	header.Set(FramedHeaderName, "true")
+
+	req := &http.Request{
+		Method:        http.MethodConnect,
+		URL:           r.url,
+		Host:          r.url.Host,
+		Header:        header,
+		Body:          pr,
+		ContentLength: -1,
+	}
+
+	resp, err := r.h2.RoundTrip(req.WithContext(streamCtx))
+	if err != nil {
+		cancel()
+		return rwcConn{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		cancel()
+		return rwcConn{}, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	stream := &http2Stream{body: resp.Body, w: pw, cancel: cancel}
+	local := rwcAddr{network: string(HTTP2Transport), v: r.url.Host}
+
+	// the server only gets to half-close the stream in-band, its response ends with the stream
+	if resp.Header.Get(FramedHeaderName) == "true" {
+		return streamRWCConn(&framedStream{rwc: stream}, local, addr), nil
+	}
+
+	return streamRWCConn(stream, local, addr), nil
+}
+
+type http2Stream struct {
+	body   io.ReadCloser
+	w      *io.PipeWriter
+	cancel context.CancelFunc
+}
+
+func (s *http2Stream) Read(p []byte) (int, error)  { return s.body.Read(p) }
+func (s *http2Stream) Write(p []byte) (int, error) { return s.w.Write(p) }
+
+// CloseWrite ends the request body, the response is read until the server ends it as well.
+func (s *http2Stream) CloseWrite() error {
+	return s.w.Close()
+}
+
+// Close ends the request body, the stream is only reset once the server had the time to receive what was written.
+func (s *http2Stream) Close() error {
+	err := s.w.Close()
+	time.AfterFunc(streamLingerTimeout, func() {
+		_ = s.body.Close()
+		s.cancel()
+	})
+	return err
+}
+
+// IsHTTP2Request reports whether the tunnel request is an HTTP/2 CONNECT stream, either plain or RFC 8441 extended CONNECT.
+func IsHTTP2Request(req *http.Request) bool {
+	return req.ProtoMajor == 2 && req.Method == http.MethodConnect
+}
+
+// AcceptHTTP2 answers an HTTP/2 CONNECT tunnel request and returns the stream as a connection, framed when
+// the client asks for it so it can be half-closed. The handler has to keep running for as long as the connection is in use.
+func AcceptHTTP2(w http.ResponseWriter, req *http.Request) (io.ReadWriteCloser, error) {
+	rc := http.NewResponseController(w)
+
+	framed := IsFramedRequest(req)
+	if framed {
+		w.Header().Set(FramedHeaderName, "true")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+
+	stream := &http2ServerStream{body: req.Body, w: w, rc: rc}
+	if framed {
+		return Framed(stream), nil
+	}
+	return stream, nil
+}
+
+// http2ServerStream can't be half-closed itself, the response only ends with the handler and ending it while the
+// request body is still open resets the stream. Clients able to half-close it frame the stream instead.
+type http2ServerStream struct {
+	sync.Mutex
+	body   io.ReadCloser
+	w      io.Writer
+	rc     *http.ResponseController
+	closed bool
+}
+
+func (s *http2ServerStream) Read(p []byte) (int, error) { return s.body.Read(p) }
+
+func (s *http2ServerStream) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// writing once the handler has returned panics, so no write may outlive Close
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, s.rc.Flush()
+}
+
+func (s *http2ServerStream) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.closed = true
+	return s.body.Close()
+}
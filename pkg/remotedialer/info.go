@@ -0,0 +1,25 @@
+package remotedialer
+
+import (
+	"context"
+)
+
+type dialInfoKey struct{}
+
+// DialInfo describes a tunnel for the access log. The caller sets the ConnectionID, which is passed on to the server,
+// the dialer fills in the rest.
+type DialInfo struct {
+	ConnectionID string
+	Transport    Transport
+	Principal    string
+}
+
+// WithDialInfo returns a context for dialing a tunnel which fills in the given info.
+func WithDialInfo(ctx context.Context, info *DialInfo) context.Context {
+	return context.WithValue(ctx, dialInfoKey{}, info)
+}
+
+func dialInfo(ctx context.Context) *DialInfo {
+	info, _ := ctx.Value(dialInfoKey{}).(*DialInfo)
+	return info
+}
@@ -0,0 +1,52 @@
+package remotedialer
+
+import (
+	"github.com/jsiebens/cloud-tunnel/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dialer",
+		Name:      "dials_total",
+		Help:      "Tunnels dialed by the client, by their result after retries.",
+	}, []string{"transport", "result"})
+
+	dialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dialer",
+		Name:      "dial_duration_seconds",
+		Help:      "Time to establish a tunnel, retries included.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"transport"})
+
+	retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dialer",
+		Name:      "retries_total",
+		Help:      "Tunnel dials retried, by the reason of the failure.",
+	}, []string{"reason"})
+
+	muxSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dialer",
+		Name:      "mux_sessions",
+		Help:      "Open yamux sessions of the client.",
+	})
+
+	muxSessionReplacements = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dialer",
+		Name:      "mux_session_replacements_total",
+		Help:      "Yamux sessions replaced because of their age or expiring credentials.",
+	})
+)
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
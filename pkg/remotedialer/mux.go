@@ -0,0 +1,450 @@
+package remotedialer
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Placement string
+
+const (
+	LeastStreams Placement = "least-streams"
+	LowestRTT    Placement = "lowest-rtt"
+)
+
+const (
+	DefaultHealthCheckInterval = 15 * time.Second
+	DefaultHealthCheckTimeout  = 5 * time.Second
+	sessionOpenTimeout         = 30 * time.Second
+	sessionExpiryMargin        = time.Minute
+)
+
+// expirer is implemented by connections that stop working at a known time, e.g. when their credentials expire
+type expirer interface {
+	Expiry() time.Time
+}
+
+type MuxOptions struct {
+	// MaxSessions is the number of sessions opened per upstream server, one when not set
+	MaxSessions int
+	// MaxStreamsPerSession is the number of streams after which an extra session is opened,
+	// when not set a new session is opened as soon as every session carries a stream
+	MaxStreamsPerSession int
+	Placement            Placement
+	WindowSize           uint32
+	KeepAliveInterval    time.Duration
+	AcceptBacklog        int
+	HealthCheckInterval  time.Duration
+	HealthCheckTimeout   time.Duration
+	// MaxSessionAge is the age after which a session is replaced and drained, zero keeps sessions forever
+	MaxSessionAge time.Duration
+}
+
+// YamuxConfig returns the yamux configuration for the options, using the yamux defaults for anything not set,
+// or an error when yamux would refuse it. A negative keepalive interval disables keepalives.
+func (o MuxOptions) YamuxConfig() (*yamux.Config, error) {
+	c := yamux.DefaultConfig()
+
+	if o.WindowSize != 0 {
+		c.MaxStreamWindowSize = o.WindowSize
+	}
+
+	if o.KeepAliveInterval < 0 {
+		c.EnableKeepAlive = false
+	} else if o.KeepAliveInterval > 0 {
+		c.KeepAliveInterval = o.KeepAliveInterval
+	}
+
+	if o.AcceptBacklog != 0 {
+		c.AcceptBacklog = o.AcceptBacklog
+	}
+
+	if err := yamux.VerifyConfig(c); err != nil {
+		return nil, fmt.Errorf("invalid mux options: %w", err)
+	}
+
+	return c, nil
+}
+
+func muxed(dialer Dialer, opts MuxOptions) Dialer {
+	if opts.MaxSessions == 0 {
+		opts.MaxSessions = 1
+	}
+	if opts.HealthCheckInterval == 0 {
+		opts.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if opts.HealthCheckTimeout == 0 {
+		opts.HealthCheckTimeout = DefaultHealthCheckTimeout
+	}
+
+	config, err := opts.YamuxConfig()
+
+	return &muxedDialer{
+		dialer: dialer,
+		opts:   opts,
+		config: config,
+		err:    err,
+		pools:  make(map[string]*sessionPool),
+	}
+}
+
+type muxedDialer struct {
+	sync.Mutex
+	dialer Dialer
+	opts   MuxOptions
+	config *yamux.Config
+	err    error
+	pools  map[string]*sessionPool
+}
+
+func (m *muxedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	session, err := m.pool(network, addr).get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &muxStream{Stream: stream}, nil
+}
+
+// muxStream makes a deadline that already passed fail reads and writes, yamux only enforces
+// deadlines while a read waits for data or a write waits for the window.
+type muxStream struct {
+	*yamux.Stream
+	readDeadline  atomic.Int64
+	writeDeadline atomic.Int64
+	closed        atomic.Bool
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	if s.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	if passed(&s.readDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	n, err := s.Stream.Read(p)
+	if err != nil && s.closed.Load() {
+		return n, net.ErrClosed
+	}
+	return n, err
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	if passed(&s.writeDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return s.Stream.Write(p)
+}
+
+// CloseWrite half-closes the stream, which is what closing a yamux stream does.
+func (s *muxStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// Close closes the stream for reading as well, a closed yamux stream is only done once the peer closes its side.
+func (s *muxStream) Close() error {
+	s.closed.Store(true)
+	_ = s.Stream.SetReadDeadline(time.Now())
+	return s.Stream.Close()
+}
+
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.readDeadline.Store(unixNano(t))
+	s.writeDeadline.Store(unixNano(t))
+	return s.Stream.SetDeadline(t)
+}
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.Store(unixNano(t))
+	return s.Stream.SetReadDeadline(t)
+}
+
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.Store(unixNano(t))
+	return s.Stream.SetWriteDeadline(t)
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func passed(deadline *atomic.Int64) bool {
+	d := deadline.Load()
+	return d != 0 && time.Now().UnixNano() >= d
+}
+
+func (m *muxedDialer) pool(network, addr string) *sessionPool {
+	k := fmt.Sprintf("%s|%s", network, addr)
+
+	m.Lock()
+	defer m.Unlock()
+
+	p := m.pools[k]
+	if p == nil {
+		p = &sessionPool{m: m, network: network, addr: addr, opened: make(chan struct{})}
+		m.pools[k] = p
+	}
+
+	return p
+}
+
+type muxSession struct {
+	*yamux.Session
+	expires  time.Time
+	rtt      atomic.Int64
+	draining atomic.Bool
+}
+
+// ping measures the round trip time, giving up after the timeout even when the connection stalls.
+func (s *muxSession) ping(timeout time.Duration) (time.Duration, error) {
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		rtt, err := s.Ping()
+		ch <- result{rtt, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.rtt, r.err
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("ping timed out after %s", timeout)
+	}
+}
+
+type sessionPool struct {
+	sync.Mutex
+	m        *muxedDialer
+	network  string
+	addr     string
+	sessions []*muxSession
+
+	// opening counts the sessions being dialed without holding the lock, they take a slot until they're done
+	opening int
+	// opened is closed once a session is done opening, for dials waiting on a slot
+	opened chan struct{}
+}
+
+func (p *sessionPool) get(ctx context.Context) (*muxSession, error) {
+	for {
+		p.Lock()
+
+		// draining sessions are left to their monitor, which closes them once their last stream is done
+		usable := p.sessions[:0]
+		for _, s := range p.sessions {
+			if !s.IsClosed() && !s.draining.Load() {
+				usable = append(usable, s)
+			}
+		}
+		p.sessions = usable
+
+		best := p.pick()
+		if p.wantsSession() {
+			p.opening++
+			p.Unlock()
+
+			s, err := p.open(ctx)
+			p.done(s)
+			if err != nil {
+				// an extra session is nice to have, an existing one still does the job
+				if best != nil {
+					return best, nil
+				}
+				return nil, err
+			}
+			return s, nil
+		}
+
+		if best != nil {
+			p.Unlock()
+			return best, nil
+		}
+
+		// every slot is taken by a session still opening
+		opened := p.opened
+		p.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-opened:
+		}
+	}
+}
+
+// done releases the slot of a session done opening, adding it to the pool when it opened.
+func (p *sessionPool) done(s *muxSession) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.opening--
+	if s != nil {
+		p.sessions = append(p.sessions, s)
+	}
+
+	close(p.opened)
+	p.opened = make(chan struct{})
+}
+
+func (p *sessionPool) open(ctx context.Context) (*muxSession, error) {
+	conn, err := p.m.dialer.DialContext(ctx, p.network, p.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := yamux.Client(conn, p.m.config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	s := &muxSession{Session: session}
+
+	if p.m.opts.MaxSessionAge > 0 {
+		s.expires = time.Now().Add(p.m.opts.MaxSessionAge)
+	}
+
+	if e, ok := conn.(expirer); ok && !e.Expiry().IsZero() {
+		// never replace a session right away, even when it was opened with credentials about to expire
+		expiry := e.Expiry().Add(-sessionExpiryMargin)
+		if earliest := time.Now().Add(sessionExpiryMargin); expiry.Before(earliest) {
+			expiry = earliest
+		}
+
+		if s.expires.IsZero() || expiry.Before(s.expires) {
+			s.expires = expiry
+		}
+	}
+
+	muxSessions.Inc()
+	go p.monitor(s)
+
+	return s, nil
+}
+
+// monitor health checks the session until it is closed, closing it when a ping fails and
+// replacing it before it reaches its maximum age or its credentials expire.
+func (p *sessionPool) monitor(s *muxSession) {
+	defer muxSessions.Dec()
+
+	opts := p.m.opts
+
+	ticker := time.NewTicker(opts.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		rtt, err := s.ping(opts.HealthCheckTimeout)
+		if err != nil {
+			if !s.IsClosed() {
+				slog.Warn("Mux session failed health check, closing", "addr", p.addr, "err", err)
+				_ = s.Close()
+			}
+			return
+		}
+		s.rtt.Store(int64(rtt))
+
+		if !s.expires.IsZero() && time.Now().After(s.expires) && !s.draining.Load() {
+			p.replace(s)
+		}
+
+		if s.draining.Load() && s.NumStreams() == 0 {
+			_ = s.Close()
+			return
+		}
+
+		select {
+		case <-s.CloseChan():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// replace opens a new session and drains the old one, new streams going to the replacement.
+func (p *sessionPool) replace(old *muxSession) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionOpenTimeout)
+	defer cancel()
+
+	muxSessionReplacements.Inc()
+
+	p.Lock()
+	p.opening++
+	p.Unlock()
+
+	s, err := p.open(ctx)
+	if err != nil {
+		// draining anyway, the next dial opens a session on demand
+		slog.Warn("Unable to replace mux session", "addr", p.addr, "err", err)
+	}
+
+	old.draining.Store(true)
+	p.done(s)
+}
+
+func (p *sessionPool) wantsSession() bool {
+	if len(p.sessions)+p.opening >= p.m.opts.MaxSessions {
+		return false
+	}
+
+	limit := max(p.m.opts.MaxStreamsPerSession, 1)
+	for _, s := range p.sessions {
+		if s.NumStreams() < limit {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *sessionPool) pick() *muxSession {
+	var best *muxSession
+
+	for _, s := range p.sessions {
+		if best == nil || p.less(s, best) {
+			best = s
+		}
+	}
+
+	return best
+}
+
+func (p *sessionPool) less(a, b *muxSession) bool {
+	if p.m.opts.Placement == LowestRTT {
+		full := func(s *muxSession) bool {
+			return p.m.opts.MaxStreamsPerSession > 0 && s.NumStreams() >= p.m.opts.MaxStreamsPerSession
+		}
+
+		if full(a) != full(b) {
+			return !full(a)
+		}
+
+		if a.rtt.Load() != b.rtt.Load() {
+			return a.rtt.Load() < b.rtt.Load()
+		}
+	}
+
+	return a.NumStreams() < b.NumStreams()
+}
@@ -0,0 +1,108 @@
+package remotedialer
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/yamux"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingDialer opens connections to a yamux server once released, counting the dials.
+type blockingDialer struct {
+	release chan struct{}
+	dials   atomic.Int32
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	d.dials.Add(1)
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.release:
+	}
+
+	c1, c2 := net.Pipe()
+
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	server, err := yamux.Server(c2, config)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(stream, stream) }()
+		}
+	}()
+
+	return c1, nil
+}
+
+func TestMuxDialsShareOpeningSession(t *testing.T) {
+	d := &blockingDialer{release: make(chan struct{})}
+	m := muxed(d, MuxOptions{MaxSessions: 1})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := m.DialContext(context.Background(), "tcp", testUpstream)
+			if err == nil {
+				_ = conn.Close()
+			}
+			errs <- err
+		}()
+	}
+
+	// a dial waiting for a session still opening gives up with its context rather than the lock
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := m.DialContext(ctx, "tcp", testUpstream); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(d.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := d.dials.Load(); n != 1 {
+		t.Fatalf("got %d dials, want 1", n)
+	}
+}
+
+func TestMuxRetriesAfterFailedOpen(t *testing.T) {
+	d := &blockingDialer{release: make(chan struct{})}
+	m := muxed(d, MuxOptions{MaxSessions: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := m.DialContext(ctx, "tcp", testUpstream); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the slot of the failed session is released
+	close(d.release)
+	conn, err := m.DialContext(context.Background(), "tcp", testUpstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
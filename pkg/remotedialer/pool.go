@@ -0,0 +1,224 @@
+package remotedialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jsiebens/cloud-tunnel/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPoolMaxIdle = time.Minute
+	// DefaultDeferredTimeout is how long the server waits for the upstream of a deferred connection,
+	// longer than pooled connections are kept idle by default
+	DefaultDeferredTimeout = 2 * DefaultPoolMaxIdle
+	poolUpgradeTimeout     = 30 * time.Second
+)
+
+// pooled returns a Dialer keeping a number of upgraded connections ready, assigning an upstream only when one is dialed.
+func pooled(r *remoteDialer, size int, maxIdle time.Duration) Dialer {
+	if maxIdle == 0 {
+		maxIdle = DefaultPoolMaxIdle
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := &pooledDialer{
+		remote:  r,
+		size:    size,
+		maxIdle: maxIdle,
+		wake:    make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	go p.fill()
+
+	return p
+}
+
+type pooledConn struct {
+	conn    rwcConn
+	created time.Time
+}
+
+type pooledDialer struct {
+	sync.Mutex
+	remote  *remoteDialer
+	size    int
+	maxIdle time.Duration
+	wake    chan struct{}
+	idle    []pooledConn
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (p *pooledDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("unsupported network '%s'", network)
+	}
+
+	ctx, span := p.remote.startSpan(ctx, addr)
+	start := time.Now()
+	conn, err := p.dial(ctx, addr)
+	p.remote.observe(start, err)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (p *pooledDialer) dial(ctx context.Context, addr string) (rwcConn, error) {
+	for {
+		conn, ok := p.take()
+		if !ok {
+			break
+		}
+
+		err := assign(ctx, conn, addr)
+		if err == nil {
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("tunnel.pooled", true))
+			conn.addr = addr
+			return conn, nil
+		}
+
+		// refusals by the server are final, anything else means the pooled connection went stale
+		var upstreamErr *UpstreamError
+		if errors.Is(err, ErrUpstreamNotAllowed) || errors.As(err, &upstreamErr) || ctx.Err() != nil {
+			return rwcConn{}, err
+		}
+	}
+
+	return p.remote.dial(ctx, addr)
+}
+
+func assign(ctx context.Context, conn rwcConn, addr string) error {
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+
+	err := WriteTarget(conn, addr)
+	if err == nil {
+		err = ReadResult(conn)
+	}
+
+	if !stop() {
+		return ctx.Err()
+	}
+
+	if err != nil {
+		_ = conn.Close()
+	}
+
+	return err
+}
+
+func (p *pooledDialer) take() (rwcConn, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.expire()
+
+	if len(p.idle) == 0 {
+		return rwcConn{}, false
+	}
+
+	pc := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+
+	return pc.conn, true
+}
+
+func (p *pooledDialer) expire() {
+	fresh := p.idle[:0]
+	for _, pc := range p.idle {
+		if time.Since(pc.created) > p.maxIdle {
+			_ = pc.conn.Close()
+			continue
+		}
+		fresh = append(fresh, pc)
+	}
+	p.idle = fresh
+}
+
+func (p *pooledDialer) fill() {
+	failures := 0
+
+	for {
+		p.Lock()
+		p.expire()
+		missing := p.size - len(p.idle)
+		p.Unlock()
+
+		if missing <= 0 {
+			select {
+			case <-p.wake:
+			case <-time.After(p.maxIdle / 2):
+			case <-p.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		conn, err := p.upgrade()
+		if err != nil {
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusBadRequest {
+				slog.Warn("Tunnel server does not support pre-warmed connections, disabling pool")
+				return
+			}
+
+			select {
+			case <-time.After(p.remote.retry.backoff(failures)):
+			case <-p.ctx.Done():
+				return
+			}
+			failures++
+			continue
+		}
+
+		failures = 0
+
+		p.Lock()
+		if p.ctx.Err() != nil {
+			p.Unlock()
+			_ = conn.Close()
+			return
+		}
+		p.idle = append(p.idle, pooledConn{conn: conn, created: time.Now()})
+		p.Unlock()
+	}
+}
+
+// Close stops filling the pool and closes the idle connections, dials after that open a connection of their own.
+func (p *pooledDialer) Close() error {
+	p.cancel()
+
+	p.Lock()
+	defer p.Unlock()
+
+	for _, pc := range p.idle {
+		_ = pc.conn.Close()
+	}
+	p.idle = nil
+
+	return nil
+}
+
+func (p *pooledDialer) upgrade() (rwcConn, error) {
+	ctx, cancel := context.WithTimeout(p.ctx, poolUpgradeTimeout)
+	defer cancel()
+	return p.remote.upgrade(ctx, "")
+}
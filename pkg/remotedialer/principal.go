@@ -0,0 +1,40 @@
+package remotedialer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// Principal returns the identity a tunnel is opened with, the email or else the subject of the bearer token.
+// The token is not verified here, that is left to what is in front of the server, like Cloud Run only letting
+// requests with a valid ID token through. Access tokens, as used over IAP, are opaque and have no principal.
+func Principal(authorization string) string {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return ""
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	var claims struct {
+		Email   string `json:"email"`
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	if claims.Email != "" {
+		return claims.Email
+	}
+	return claims.Subject
+}
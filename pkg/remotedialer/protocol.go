@@ -0,0 +1,117 @@
+package remotedialer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A connection upgraded with the DeferredHeaderName header carries no upstream yet.
+// Once the client needs it, it sends the upstream as a length-prefixed string and the server
+// answers with a result code and a length-prefixed message before the connection turns into a plain tunnel.
+
+const maxTargetLength = 1024
+
+const (
+	resultOK byte = iota
+	resultNotAllowed
+	resultDialFailed
+)
+
+var (
+	ErrUpstreamNotAllowed = errors.New("upstream not allowed")
+	// ErrLimitExceeded is returned by a GRPCHandler refusing a tunnel because of the limits of the server
+	ErrLimitExceeded = errors.New("limit exceeded")
+	// ErrDraining is returned by a GRPCHandler refusing a tunnel because the server is shutting down
+	ErrDraining = errors.New("server draining")
+)
+
+// UpstreamError is returned when the tunnel server was unable to dial the upstream of a deferred connection.
+type UpstreamError struct {
+	Message string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("unable to dial upstream: %s", e.Message)
+}
+
+func WriteTarget(w io.Writer, target string) error {
+	if len(target) > maxTargetLength {
+		return fmt.Errorf("target exceeds %d bytes", maxTargetLength)
+	}
+	return writeString(w, target)
+}
+
+func ReadTarget(r io.Reader) (string, error) {
+	return readString(r, maxTargetLength)
+}
+
+// WriteResult writes the outcome of dialing the upstream, a nil dialErr meaning success.
+func WriteResult(w io.Writer, allowed bool, dialErr error) error {
+	code, message := resultOK, ""
+	switch {
+	case !allowed:
+		code = resultNotAllowed
+	case dialErr != nil:
+		code, message = resultDialFailed, dialErr.Error()
+	}
+
+	if len(message) > maxTargetLength {
+		message = message[:maxTargetLength]
+	}
+
+	if _, err := w.Write([]byte{code}); err != nil {
+		return err
+	}
+	return writeString(w, message)
+}
+
+func ReadResult(r io.Reader) error {
+	code := [1]byte{}
+	if _, err := io.ReadFull(r, code[:]); err != nil {
+		return err
+	}
+
+	message, err := readString(r, maxTargetLength)
+	if err != nil {
+		return err
+	}
+
+	switch code[0] {
+	case resultOK:
+		return nil
+	case resultNotAllowed:
+		return ErrUpstreamNotAllowed
+	default:
+		return &UpstreamError{Message: message}
+	}
+}
+
+func writeString(w io.Writer, s string) error {
+	buf := make([]byte, 2+len(s))
+	binary.BigEndian.PutUint16(buf, uint16(len(s)))
+	copy(buf[2:], s)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readString(r io.Reader, max int) (string, error) {
+	buf := [2]byte{}
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return "", err
+	}
+
+	n := int(binary.BigEndian.Uint16(buf[:]))
+	if n > max {
+		return "", fmt.Errorf("length %d exceeds %d bytes", n, max)
+	}
+
+	s := make([]byte, n)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+
+	return string(s), nil
+}
@@ -0,0 +1,131 @@
+package remotedialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jsiebens/cloud-tunnel/pkg/iap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultMaxAttempts    = 4
+	DefaultInitialBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff     = 2 * time.Second
+)
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = DefaultMaxAttempts
+	}
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = DefaultInitialBackoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = DefaultMaxBackoff
+	}
+	return p
+}
+
+// backoff returns a random delay up to the exponential backoff for the given attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MaxBackoff
+	if attempt < 32 {
+		d = min(p.InitialBackoff<<attempt, p.MaxBackoff)
+	}
+	return rand.N(d) + 1
+}
+
+// StatusError is returned when the tunnel server answers the upgrade request with anything but 101 Switching Protocols.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("invalid response: %s", e.Status)
+}
+
+// retryReason classifies a dial error, returning the reason to retry or false when retrying won't help.
+func retryReason(err error) (string, bool) {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return fmt.Sprintf("status_%d", statusErr.StatusCode), true
+		}
+		return "", false
+	}
+
+	var iapErr *iap.Error
+	if errors.As(err, &iapErr) {
+		return fmt.Sprintf("iap_%d", int(iapErr.Code)), iapErr.Temporary()
+	}
+
+	var iapStatusErr *iap.StatusError
+	if errors.As(err, &iapStatusErr) {
+		return fmt.Sprintf("iap_status_%d", iapStatusErr.StatusCode), iapStatusErr.Temporary()
+	}
+
+	if status.Code(err) == codes.Unavailable {
+		return "grpc_unavailable", true
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) {
+		return "connection_reset", true
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "connection_closed", true
+	}
+
+	return "", false
+}
+
+type noRetriesKey struct{}
+
+// withoutRetries returns a context for a dial failing over to another endpoint rather than being retried.
+func withoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetriesKey{}, true)
+}
+
+func retriesAllowed(ctx context.Context) bool {
+	noRetries, _ := ctx.Value(noRetriesKey{}).(bool)
+	return !noRetries
+}
+
+func withRetries(ctx context.Context, policy RetryPolicy, dial func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := dial()
+		if err == nil || attempt+1 >= policy.MaxAttempts || ctx.Err() != nil || !retriesAllowed(ctx) {
+			return err
+		}
+
+		reason, ok := retryReason(err)
+		if !ok {
+			return err
+		}
+
+		retries.WithLabelValues(reason).Inc()
+		slog.Debug("Retrying tunnel dial", "attempt", attempt+1, "reason", reason, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(policy.backoff(attempt)):
+		}
+	}
+}
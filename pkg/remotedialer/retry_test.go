@@ -0,0 +1,89 @@
+package remotedialer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jsiebens/cloud-tunnel/pkg/iap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		reason string
+		retry  bool
+	}{
+		{"too many requests", &StatusError{StatusCode: http.StatusTooManyRequests}, "status_429", true},
+		{"bad gateway", &StatusError{StatusCode: http.StatusBadGateway}, "status_502", true},
+		{"service unavailable", &StatusError{StatusCode: http.StatusServiceUnavailable}, "status_503", true},
+		{"gateway timeout", &StatusError{StatusCode: http.StatusGatewayTimeout}, "status_504", true},
+		{"forbidden", &StatusError{StatusCode: http.StatusForbidden}, "", false},
+		{"not found", fmt.Errorf("dial: %w", &StatusError{StatusCode: http.StatusNotFound}), "", false},
+		{"iap temporary", &iap.Error{Code: 4000}, "iap_4000", true},
+		{"iap not authorized", &iap.Error{Code: 4033}, "iap_4033", false},
+		{"iap too many requests", &iap.StatusError{StatusCode: http.StatusTooManyRequests}, "iap_status_429", true},
+		{"iap internal error", &iap.StatusError{StatusCode: http.StatusInternalServerError}, "iap_status_500", true},
+		{"iap unauthorized", &iap.StatusError{StatusCode: http.StatusUnauthorized}, "iap_status_401", false},
+		{"grpc unavailable", status.Error(codes.Unavailable, "draining"), "grpc_unavailable", true},
+		{"grpc permission denied", status.Error(codes.PermissionDenied, "denied"), "", false},
+		{"connection reset", fmt.Errorf("read: %w", syscall.ECONNRESET), "connection_reset", true},
+		{"eof", io.EOF, "connection_closed", true},
+		{"unexpected eof", io.ErrUnexpectedEOF, "connection_closed", true},
+		{"other", errors.New("no route to host"), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, retry := retryReason(tt.err)
+			if reason != tt.reason || retry != tt.retry {
+				t.Fatalf("got (%q, %t), want (%q, %t)", reason, retry, tt.reason, tt.retry)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{31, time.Second},
+		{64, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("attempt=%d", tt.attempt), func(t *testing.T) {
+			for range 1000 {
+				if d := p.backoff(tt.attempt); d <= 0 || d > tt.max {
+					t.Fatalf("got %v, want a delay in (0, %v]", d, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffIsJittered(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	seen := make(map[time.Duration]bool)
+	for range 100 {
+		seen[p.backoff(3)] = true
+	}
+	if len(seen) < 50 {
+		t.Fatalf("got %d distinct delays out of 100, want them spread", len(seen))
+	}
+}
@@ -0,0 +1,114 @@
+package remotedialer
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"nhooyr.io/websocket"
+)
+
+const WebSocketSubprotocol = "cloud-tunnel"
+
+// closeWriteMessage is sent as a text message when a side of the tunnel won't write anymore, data is sent as binary messages.
+const closeWriteMessage = "close-write"
+
+// dialWebSocket opens the tunnel as a proper RFC 6455 WebSocket, for proxies and load balancers validating the handshake and frames.
+func (r *remoteDialer) dialWebSocket(ctx context.Context, tr *http.Transport, header http.Header, addr string, raw func() net.Conn) (rwcConn, error) {
+	opts := &websocket.DialOptions{
+		HTTPClient:      &http.Client{Transport: tr},
+		HTTPHeader:      header,
+		Subprotocols:    []string{WebSocketSubprotocol},
+		CompressionMode: websocket.CompressionDisabled,
+	}
+
+	c, resp, err := websocket.Dial(ctx, r.url.String(), opts)
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			return rwcConn{}, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		return rwcConn{}, err
+	}
+
+	// deadlines on the WebSocket close it, so they are handled on top
+	return streamRWCConn(&webSocketStream{c: c}, raw().LocalAddr(), addr), nil
+}
+
+// IsWebSocketRequest reports whether the upgrade request is a proper WebSocket handshake rather than a plain upgrade.
+func IsWebSocketRequest(req *http.Request) bool {
+	return req.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+// AcceptWebSocket completes the WebSocket handshake of a tunnel request, writing the error response itself when it fails.
+func AcceptWebSocket(w http.ResponseWriter, req *http.Request) (io.ReadWriteCloser, error) {
+	c, err := websocket.Accept(w, req, &websocket.AcceptOptions{
+		Subprotocols:       []string{WebSocketSubprotocol},
+		InsecureSkipVerify: true,
+		CompressionMode:    websocket.CompressionDisabled,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &webSocketStream{c: c}, nil
+}
+
+// webSocketStream reads and writes the tunnel as WebSocket messages. Unlike websocket.NetConn it performs
+// the close handshake even while a read is in progress, and it is able to half-close the tunnel.
+type webSocketStream struct {
+	c   *websocket.Conn
+	r   io.Reader
+	eof bool
+}
+
+func (s *webSocketStream) Read(p []byte) (int, error) {
+	for {
+		if s.eof {
+			return 0, io.EOF
+		}
+
+		if s.r == nil {
+			typ, r, err := s.c.Reader(context.Background())
+			if err != nil {
+				switch websocket.CloseStatus(err) {
+				case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+
+			if typ == websocket.MessageText {
+				_, _ = io.Copy(io.Discard, r)
+				s.eof = true
+				continue
+			}
+
+			s.r = r
+		}
+
+		n, err := s.r.Read(p)
+		if err == io.EOF {
+			s.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (s *webSocketStream) Write(p []byte) (int, error) {
+	if err := s.c.Write(context.Background(), websocket.MessageBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *webSocketStream) CloseWrite() error {
+	return s.c.Write(context.Background(), websocket.MessageText, []byte(closeWriteMessage))
+}
+
+func (s *webSocketStream) Close() error {
+	return s.c.Close(websocket.StatusNormalClosure, "")
+}